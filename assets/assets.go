@@ -0,0 +1,366 @@
+// Package assets loads files such as scenes, prefabs and configuration in the background. Loaders are registered by
+// file extension, and Load hands out a typed handle right away while the file is read and decoded on a worker
+// goroutine:
+//
+//	server := assets.NewServer(os.DirFS("assets"))
+//	err := server.AddLoader(assets.NewLoader(parseConfig, "config.json"))
+//	game.Plug(assets.Plugin(server))
+//
+//	handle, err := assets.Load[config](server, "levels/one.config.json")
+//	if cfg, ok := handle.Get(); ok {
+//	  // Use the config once it is loaded, handle.State() and handle.Err() tell how loading went.
+//	}
+//
+// Loading the same path again shares the asset. Every Load and Clone adds a reference to it, and it is unloaded once
+// all of them are released.
+//
+// Servers created WithWatcher reload assets whose files changed, and the plugin sends an AssetModified event for every
+// reloaded asset so systems can rebuild what they derived from it.
+package assets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/otanriverdi/hayal"
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+// LoadState is how far loading an asset got.
+type LoadState int
+
+const (
+	// NotLoaded is the state of zero handles and unloaded assets.
+	NotLoaded LoadState = iota
+	// Loading assets are queued or being loaded by a worker.
+	Loading
+	// Loaded assets can be read with Get.
+	Loaded
+	// Failed assets couldn't be read or decoded, Err returns why.
+	Failed
+)
+
+// AssetLoader decodes files into assets. A loader that panics fails the asset instead of crashing the game.
+type AssetLoader interface {
+	// Extensions returns the file extensions the loader handles without the leading dot, such as "json" or
+	// "scene.yaml". The longest matching extension wins.
+	Extensions() []string
+	// Load decodes the contents of the file at path. It runs on worker goroutines, possibly for multiple files at once.
+	Load(path string, data []byte) (any, error)
+}
+
+type funcLoader[T any] struct {
+	extensions []string
+	load       func(data []byte) (T, error)
+}
+
+func (l *funcLoader[T]) Extensions() []string {
+	return l.extensions
+}
+
+func (l *funcLoader[T]) Load(_ string, data []byte) (any, error) {
+	return l.load(data)
+}
+
+// NewLoader creates a loader for the extensions out of a decoding function.
+func NewLoader[T any](load func(data []byte) (T, error), extensions ...string) AssetLoader {
+	return &funcLoader[T]{extensions: extensions, load: load}
+}
+
+type asset struct {
+	id        uint64
+	path      string
+	assetType reflect.Type
+	loader    AssetLoader
+	refs      int
+	state     LoadState
+	value     any
+	err       error
+	// File the value was loaded from, compared against by the watcher
+	stamp     fileStamp
+	reloading bool
+	// notify is set while the asset waits in the modified list of the server
+	notify bool
+	event  func(world *ecs.ECS)
+}
+
+type options struct {
+	workers int
+	watch   time.Duration
+}
+
+// Option configures a server created with NewServer.
+type Option func(opts *options)
+
+// WithWorkers sets the number of goroutines loading assets. It defaults to the number of CPUs.
+func WithWorkers(n int) Option {
+	return func(opts *options) {
+		opts.workers = n
+	}
+}
+
+// Server loads assets from a file system and keeps them around while they are referenced. It is safe for concurrent
+// use.
+type Server struct {
+	fsys fs.FS
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	loaders  map[string]AssetLoader
+	paths    map[string]*asset
+	assets   map[uint64]*asset
+	nextId   uint64
+	queue    []*asset
+	inFlight int
+	modified []*asset
+	closed   bool
+	stop     chan struct{}
+	workers  sync.WaitGroup
+}
+
+// NewServer starts a server loading assets from fsys. Close it to stop its workers.
+func NewServer(fsys fs.FS, opts ...Option) *Server {
+	o := options{workers: runtime.NumCPU()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := &Server{
+		fsys:    fsys,
+		loaders: make(map[string]AssetLoader),
+		paths:   make(map[string]*asset),
+		assets:  make(map[uint64]*asset),
+		stop:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for range max(o.workers, 1) {
+		s.workers.Add(1)
+		go s.work()
+	}
+	if o.watch > 0 {
+		s.workers.Add(1)
+		go s.watch(o.watch)
+	}
+	return s
+}
+
+// AddLoader registers the loader for its extensions.
+func (s *Server) AddLoader(loader AssetLoader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ext := range loader.Extensions() {
+		if _, ok := s.loaders[ext]; ok {
+			return fmt.Errorf("Extension %q already has a loader", ext)
+		}
+	}
+	for _, ext := range loader.Extensions() {
+		s.loaders[ext] = loader
+	}
+	return nil
+}
+
+// loader finds the loader of the longest extension of the file.
+func (s *Server) loader(file string) (AssetLoader, bool) {
+	name := path.Base(file)
+	for i := 0; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if loader, ok := s.loaders[name[i+1:]]; ok {
+			return loader, true
+		}
+	}
+	return nil, false
+}
+
+// Load returns a handle to the asset at path, queueing it to be loaded if it isn't loaded yet. Paths are slash
+// separated and relative to the root of the server's file system.
+func Load[T any](s *Server, path string) (Handle[T], error) {
+	assetType := reflect.TypeFor[T]()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return Handle[T]{}, errors.New("Server is closed")
+	}
+	if a, ok := s.paths[path]; ok {
+		if a.assetType != assetType {
+			return Handle[T]{}, fmt.Errorf("Asset %q is already loaded as %v", path, a.assetType)
+		}
+		a.refs++
+		return Handle[T]{server: s, id: a.id}, nil
+	}
+	loader, ok := s.loader(path)
+	if !ok {
+		return Handle[T]{}, fmt.Errorf("No loader for %q", path)
+	}
+	s.nextId++
+	a := &asset{id: s.nextId, path: path, assetType: assetType, loader: loader, refs: 1, state: Loading}
+	a.event = func(world *ecs.ECS) {
+		ecs.SendEvent(world, AssetModified[T]{Handle: Handle[T]{server: s, id: a.id}})
+	}
+	s.paths[path] = a
+	s.assets[a.id] = a
+	s.enqueue(a)
+	return Handle[T]{server: s, id: a.id}, nil
+}
+
+func (s *Server) enqueue(a *asset) {
+	s.queue = append(s.queue, a)
+	s.cond.Signal()
+}
+
+func (s *Server) work() {
+	defer s.workers.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			return
+		}
+		a := s.queue[0]
+		s.queue = s.queue[1:]
+		s.inFlight++
+		s.mu.Unlock()
+		value, stamp, err := s.read(a)
+		s.mu.Lock()
+		s.inFlight--
+		s.finish(a, value, stamp, err)
+		s.cond.Broadcast()
+	}
+}
+
+// read loads the asset without holding the lock of the server. Panicking loaders fail the asset instead of crashing
+// the game, as they may be fed half written files by the watcher.
+func (s *Server) read(a *asset) (value any, stamp fileStamp, err error) {
+	info, err := fs.Stat(s.fsys, a.path)
+	if err != nil {
+		return nil, fileStamp{}, err
+	}
+	stamp = stampOf(info)
+	data, err := fs.ReadFile(s.fsys, a.path)
+	if err != nil {
+		return nil, stamp, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, fmt.Errorf("Loader of %q panicked: %v", a.path, r)
+		}
+	}()
+	value, err = a.loader.Load(a.path, data)
+	if err != nil {
+		return nil, stamp, err
+	}
+	if value == nil || !reflect.TypeOf(value).AssignableTo(a.assetType) {
+		return nil, stamp, fmt.Errorf("Loader of %q returned %T instead of %v", a.path, value, a.assetType)
+	}
+	return value, stamp, nil
+}
+
+func (s *Server) finish(a *asset, value any, stamp fileStamp, err error) {
+	if s.assets[a.id] != a {
+		// Released while it was loading.
+		unload(value)
+		return
+	}
+	reload := a.reloading
+	a.reloading = false
+	// The stamp is kept even if loading failed, so broken files are only reloaded once they change again.
+	a.stamp = stamp
+	if err != nil {
+		a.err = err
+		if a.state != Loaded {
+			a.state = Failed
+		}
+		return
+	}
+	if reload {
+		unload(a.value)
+		if !a.notify {
+			a.notify = true
+			s.modified = append(s.modified, a)
+		}
+	}
+	a.state, a.value, a.err = Loaded, value, nil
+}
+
+// Wait blocks until every queued asset finished loading, for loading screens and tests.
+func (s *Server) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for (len(s.queue) > 0 || s.inFlight > 0) && !s.closed {
+		s.cond.Wait()
+	}
+}
+
+// Close stops the workers once the assets being loaded are done. Assets that are still queued fail to load.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for _, a := range s.queue {
+		a.reloading = false
+		if a.state == Loading {
+			a.state, a.err = Failed, errors.New("Server is closed")
+		}
+	}
+	s.queue = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	close(s.stop)
+	s.workers.Wait()
+}
+
+func (s *Server) release(id uint64) error {
+	if s == nil {
+		return errors.New("Asset is not loaded")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.assets[id]
+	if !ok {
+		return errors.New("Asset is not loaded")
+	}
+	a.refs--
+	if a.refs > 0 {
+		return nil
+	}
+	delete(s.assets, a.id)
+	delete(s.paths, a.path)
+	unload(a.value)
+	return nil
+}
+
+// unload closes assets holding on to resources that outlive them.
+func unload(value any) {
+	if closer, ok := value.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Plugin inserts the server as a resource, so systems can load assets through ecs.Resource[*assets.Server], sends
+// AssetModified events for reloaded assets in PreUpdate and closes the server in Deinit.
+func Plugin(server *Server) hayal.Plugin {
+	return func(g *hayal.Game) {
+		ecs.InsertResource(g.World(), server)
+		g.AddSystem(hayal.GameLoopStepPreUpdate, func(ctx hayal.SystemCtx) error {
+			server.sendEvents(ctx.World())
+			return nil
+		}, hayal.Named("assets.events"), hayal.Uses())
+		g.AddSystem(hayal.GameLoopStateDeinit, func(ctx hayal.SystemCtx) error {
+			server.Close()
+			return nil
+		}, hayal.Named("assets.close"), hayal.Uses())
+	}
+}
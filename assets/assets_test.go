@@ -0,0 +1,275 @@
+package assets
+
+import (
+	"io/fs"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/otanriverdi/hayal"
+	"github.com/otanriverdi/hayal/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+type texture struct {
+	name   string
+	closed *bool
+}
+
+func (t *texture) Close() error {
+	*t.closed = true
+	return nil
+}
+
+// editableFS lets tests change files while the watcher reads them.
+type editableFS struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+}
+
+func (f *editableFS) Open(name string) (fs.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.files.Open(name)
+}
+
+func (f *editableFS) write(name string, data string, modTime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[name] = &fstest.MapFile{Data: []byte(data), ModTime: modTime}
+}
+
+func TestServer(t *testing.T) {
+	fsys := fstest.MapFS{
+		"levels/one.num":   {Data: []byte("1")},
+		"levels/bad.num":   {Data: []byte("one")},
+		"player.tex":       {Data: []byte("player")},
+		"player.small.tex": {Data: []byte("small")},
+	}
+	atoi := func(data []byte) (int, error) {
+		return strconv.Atoi(string(data))
+	}
+	numbers := NewLoader(atoi, "num")
+
+	t.Run("loads assets in the background", func(t *testing.T) {
+		server := NewServer(fsys)
+		defer server.Close()
+		assert.NoError(t, server.AddLoader(numbers))
+		handle, err := Load[int](server, "levels/one.num")
+		assert.NoError(t, err)
+		assert.Equal(t, "levels/one.num", handle.Path())
+		server.Wait()
+		assert.Equal(t, Loaded, handle.State())
+		value, ok := handle.Get()
+		assert.True(t, ok)
+		assert.Equal(t, 1, value)
+
+		var zero Handle[int]
+		assert.Equal(t, NotLoaded, zero.State())
+		_, ok = zero.Get()
+		assert.False(t, ok)
+	})
+
+	t.Run("reports failures", func(t *testing.T) {
+		server := NewServer(fsys)
+		defer server.Close()
+		assert.NoError(t, server.AddLoader(numbers))
+		bad, err := Load[int](server, "levels/bad.num")
+		assert.NoError(t, err)
+		missing, err := Load[int](server, "levels/two.num")
+		assert.NoError(t, err)
+		mistyped, err := Load[string](server, "levels/one.num")
+		assert.NoError(t, err)
+		assert.NoError(t, server.AddLoader(NewLoader(func(data []byte) (string, error) {
+			panic("corrupt texture")
+		}, "tex")))
+		corrupt, err := Load[string](server, "player.tex")
+		assert.NoError(t, err)
+		server.Wait()
+		assert.Equal(t, Failed, bad.State())
+		assert.EqualError(t, bad.Err(), `strconv.Atoi: parsing "one": invalid syntax`)
+		assert.Equal(t, Failed, missing.State())
+		assert.ErrorIs(t, missing.Err(), fs.ErrNotExist)
+		assert.EqualError(t, mistyped.Err(), `Loader of "levels/one.num" returned int instead of string`)
+		assert.Equal(t, Failed, corrupt.State())
+		assert.EqualError(t, corrupt.Err(), `Loader of "player.tex" panicked: corrupt texture`)
+
+		_, err = Load[int](server, "levels/one.num")
+		assert.EqualError(t, err, `Asset "levels/one.num" is already loaded as string`)
+		_, err = Load[int](server, "player.png")
+		assert.EqualError(t, err, `No loader for "player.png"`)
+		assert.EqualError(t, server.AddLoader(NewLoader(atoi, "txt", "num")), `Extension "num" already has a loader`)
+	})
+
+	t.Run("picks the longest extension", func(t *testing.T) {
+		server := NewServer(fsys)
+		defer server.Close()
+		load := func(suffix string) AssetLoader {
+			return NewLoader(func(data []byte) (string, error) {
+				return string(data) + suffix, nil
+			}, suffix)
+		}
+		assert.NoError(t, server.AddLoader(load("tex")))
+		assert.NoError(t, server.AddLoader(load("small.tex")))
+		full, err := Load[string](server, "player.tex")
+		assert.NoError(t, err)
+		small, err := Load[string](server, "player.small.tex")
+		assert.NoError(t, err)
+		server.Wait()
+		value, _ := full.Get()
+		assert.Equal(t, "playertex", value)
+		value, _ = small.Get()
+		assert.Equal(t, "smallsmall.tex", value)
+	})
+
+	t.Run("unloads unreferenced assets", func(t *testing.T) {
+		server := NewServer(fsys, WithWorkers(1))
+		defer server.Close()
+		closed := false
+		assert.NoError(t, server.AddLoader(NewLoader(func(data []byte) (*texture, error) {
+			return &texture{name: string(data), closed: &closed}, nil
+		}, "tex")))
+		a, err := Load[*texture](server, "player.tex")
+		assert.NoError(t, err)
+		b, err := Load[*texture](server, "player.tex")
+		assert.NoError(t, err)
+		assert.Equal(t, a, b, "loading a path again shares the asset")
+		c := a.Clone()
+		server.Wait()
+
+		assert.NoError(t, a.Release())
+		assert.NoError(t, b.Release())
+		value, ok := c.Get()
+		assert.True(t, ok)
+		assert.Equal(t, "player", value.name)
+		assert.False(t, closed)
+		assert.NoError(t, c.Release())
+		assert.True(t, closed)
+		assert.Equal(t, NotLoaded, c.State())
+		assert.EqualError(t, c.Release(), "Asset is not loaded")
+
+		d, err := Load[*texture](server, "player.tex")
+		assert.NoError(t, err)
+		assert.NotEqual(t, a, d, "unloaded assets are loaded again")
+	})
+
+	t.Run("drops assets released while loading", func(t *testing.T) {
+		server := NewServer(fsys, WithWorkers(1))
+		defer server.Close()
+		unblock := make(chan struct{})
+		closed := false
+		assert.NoError(t, server.AddLoader(NewLoader(func(data []byte) (*texture, error) {
+			<-unblock
+			return &texture{name: string(data), closed: &closed}, nil
+		}, "tex")))
+		handle, err := Load[*texture](server, "player.tex")
+		assert.NoError(t, err)
+		assert.Equal(t, Loading, handle.State())
+		assert.NoError(t, handle.Release())
+		close(unblock)
+		server.Wait()
+		assert.Equal(t, NotLoaded, handle.State())
+		assert.True(t, closed)
+	})
+
+	t.Run("polls from systems", func(t *testing.T) {
+		server := NewServer(fsys)
+		assert.NoError(t, server.AddLoader(numbers))
+		game := hayal.New()
+		game.Plug(Plugin(server))
+		var handle Handle[int]
+		game.AddSystem(hayal.GameLoopStepInit, func(ctx hayal.SystemCtx) error {
+			server, err := ecs.Resource[*Server](ctx.World())
+			if err != nil {
+				return err
+			}
+			handle, err = Load[int](server, "levels/one.num")
+			return err
+		})
+		loaded := 0
+		game.AddSystem(hayal.GameLoopStateUpdate, func(ctx hayal.SystemCtx) error {
+			if value, ok := handle.Get(); ok {
+				loaded = value
+				ctx.Exit()
+			}
+			return nil
+		})
+		game.Run()
+		assert.Equal(t, 1, loaded)
+		_, err := Load[int](server, "levels/one.num")
+		assert.EqualError(t, err, "Server is closed", "the server is closed in Deinit")
+	})
+	t.Run("reloads modified files", func(t *testing.T) {
+		files := &editableFS{files: fstest.MapFS{}}
+		start := time.Unix(0, 0)
+		files.write("one.num", "1", start)
+		server := NewServer(files, WithWatcher(time.Hour))
+		defer server.Close()
+		assert.NoError(t, server.AddLoader(numbers))
+		handle, err := Load[int](server, "one.num")
+		assert.NoError(t, err)
+		server.Wait()
+
+		server.poll()
+		server.Wait()
+		server.mu.Lock()
+		assert.Empty(t, server.modified, "unchanged files are not reloaded")
+		server.mu.Unlock()
+
+		files.write("one.num", "11", start.Add(time.Second))
+		server.poll()
+		server.Wait()
+		value, _ := handle.Get()
+		assert.Equal(t, 11, value)
+
+		files.write("one.num", "eleven", start.Add(2*time.Second))
+		server.poll()
+		server.Wait()
+		value, ok := handle.Get()
+		assert.True(t, ok, "assets that fail to reload keep their value")
+		assert.Equal(t, 11, value)
+		assert.Error(t, handle.Err())
+
+		files.write("one.num", "12", start.Add(3*time.Second))
+		server.poll()
+		server.Wait()
+		value, _ = handle.Get()
+		assert.Equal(t, 12, value)
+		assert.NoError(t, handle.Err())
+	})
+
+	t.Run("sends modified events", func(t *testing.T) {
+		files := &editableFS{files: fstest.MapFS{}}
+		files.write("one.num", "1", time.Unix(0, 0))
+		files.write("player.tex", "player", time.Unix(0, 0))
+		server := NewServer(files, WithWatcher(time.Millisecond))
+		assert.NoError(t, server.AddLoader(numbers))
+		assert.NoError(t, server.AddLoader(NewLoader(func(data []byte) (string, error) {
+			return string(data), nil
+		}, "tex")))
+		number, err := Load[int](server, "one.num")
+		assert.NoError(t, err)
+		_, err = Load[string](server, "player.tex")
+		assert.NoError(t, err)
+		server.Wait()
+
+		game := hayal.New()
+		game.Plug(Plugin(server))
+		numbers := ecs.NewEventReader[AssetModified[int]](game.World())
+		textures := ecs.NewEventReader[AssetModified[string]](game.World())
+		game.Step()
+		assert.Empty(t, numbers.Read())
+
+		files.write("one.num", "2", time.Unix(1, 0))
+		assert.Eventually(t, func() bool {
+			value, _ := number.Get()
+			return value == 2
+		}, time.Second, time.Millisecond, "the watcher reloads the file")
+		game.Step()
+		assert.Equal(t, []AssetModified[int]{{Handle: number}}, numbers.Read())
+		assert.Empty(t, textures.Read())
+		game.Shutdown()
+	})
+}
@@ -0,0 +1,73 @@
+package assets
+
+// Handle refers to an asset of type T. Handles are cheap to copy and compare, copies share the reference taken by
+// Load, so use Clone for a reference that is released separately. The zero handle refers to no asset.
+type Handle[T any] struct {
+	server *Server
+	id     uint64
+}
+
+// lookup calls fn with the asset of the handle under the lock of its server, unless it is unloaded.
+func (h Handle[T]) lookup(fn func(a *asset)) {
+	if h.server == nil {
+		return
+	}
+	h.server.mu.Lock()
+	defer h.server.mu.Unlock()
+	if a, ok := h.server.assets[h.id]; ok {
+		fn(a)
+	}
+}
+
+// State returns how far loading the asset got.
+func (h Handle[T]) State() LoadState {
+	state := NotLoaded
+	h.lookup(func(a *asset) {
+		state = a.state
+	})
+	return state
+}
+
+// Get returns the asset if it is loaded.
+func (h Handle[T]) Get() (T, bool) {
+	var value T
+	loaded := false
+	h.lookup(func(a *asset) {
+		if a.state == Loaded {
+			value, loaded = a.value.(T), true
+		}
+	})
+	return value, loaded
+}
+
+// Err returns why the last attempt at loading the asset failed. Assets that fail to reload keep their previous value.
+func (h Handle[T]) Err() error {
+	var err error
+	h.lookup(func(a *asset) {
+		err = a.err
+	})
+	return err
+}
+
+// Path returns the path the asset is loaded from.
+func (h Handle[T]) Path() string {
+	var path string
+	h.lookup(func(a *asset) {
+		path = a.path
+	})
+	return path
+}
+
+// Clone adds a reference to the asset, to be released on its own.
+func (h Handle[T]) Clone() Handle[T] {
+	h.lookup(func(a *asset) {
+		a.refs++
+	})
+	return h
+}
+
+// Release drops the reference of the handle, unloading the asset once no references are left. Loaded assets
+// implementing io.Closer are closed when they are unloaded.
+func (h Handle[T]) Release() error {
+	return h.server.release(h.id)
+}
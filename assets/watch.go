@@ -0,0 +1,102 @@
+package assets
+
+import (
+	"io/fs"
+	"time"
+
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+// AssetModified is sent by the plugin when an asset was reloaded because its file changed.
+type AssetModified[T any] struct {
+	Handle Handle[T]
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(info fs.FileInfo) fileStamp {
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+func (f fileStamp) equal(other fileStamp) bool {
+	return f.modTime.Equal(other.modTime) && f.size == other.size
+}
+
+// WithWatcher makes the server poll the files of its assets every interval and reload the ones that changed. Files
+// are compared by their modification time and size, which works on any file system without extra dependencies.
+func WithWatcher(interval time.Duration) Option {
+	return func(opts *options) {
+		opts.watch = interval
+	}
+}
+
+func (s *Server) watch(interval time.Duration) {
+	defer s.workers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.poll()
+		}
+	}
+}
+
+// poll queues every asset whose file changed since it was loaded to be reloaded.
+func (s *Server) poll() {
+	type watched struct {
+		a     *asset
+		stamp fileStamp
+	}
+	s.mu.Lock()
+	files := make([]watched, 0, len(s.assets))
+	for _, a := range s.assets {
+		if a.state != Loading && !a.reloading {
+			files = append(files, watched{a: a, stamp: a.stamp})
+		}
+	}
+	s.mu.Unlock()
+
+	var changed []*asset
+	for _, file := range files {
+		info, err := fs.Stat(s.fsys, file.a.path)
+		if err != nil {
+			// Files that are being replaced may be missing for a moment, they are picked up on a later poll.
+			continue
+		}
+		if !stampOf(info).equal(file.stamp) {
+			changed = append(changed, file.a)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range changed {
+		if s.assets[a.id] == a && !a.reloading && !s.closed {
+			a.reloading = true
+			s.enqueue(a)
+		}
+	}
+}
+
+// sendEvents sends the AssetModified events of the assets reloaded since the last call.
+func (s *Server) sendEvents(world *ecs.ECS) {
+	s.mu.Lock()
+	var modified []*asset
+	for _, a := range s.modified {
+		a.notify = false
+		if s.assets[a.id] == a {
+			modified = append(modified, a)
+		}
+	}
+	s.modified = nil
+	s.mu.Unlock()
+	for _, a := range modified {
+		a.event(world)
+	}
+}
@@ -0,0 +1,74 @@
+package ecs
+
+import (
+	"reflect"
+	"slices"
+)
+
+// Access describes the components and resources something reads and writes. Schedulers use it to find out which
+// systems can safely run in parallel.
+type Access struct {
+	cmpReads  []reflect.Type
+	cmpWrites []reflect.Type
+	resReads  []reflect.Type
+	resWrites []reflect.Type
+}
+
+// AccessDeclarer is implemented by anything that can declare its access, such as typed queries and Access itself.
+type AccessDeclarer interface {
+	Access() Access
+}
+
+// ReadComponent declares reading the component T.
+func ReadComponent[T any]() Access {
+	return Access{cmpReads: []reflect.Type{reflect.TypeFor[T]()}}
+}
+
+// WriteComponent declares reading and writing the component T.
+func WriteComponent[T any]() Access {
+	return Access{cmpWrites: []reflect.Type{reflect.TypeFor[T]()}}
+}
+
+// ReadResource declares reading the resource T.
+func ReadResource[T any]() Access {
+	return Access{resReads: []reflect.Type{reflect.TypeFor[T]()}}
+}
+
+// WriteResource declares reading and writing the resource T.
+func WriteResource[T any]() Access {
+	return Access{resWrites: []reflect.Type{reflect.TypeFor[T]()}}
+}
+
+func (a Access) Access() Access {
+	return a
+}
+
+// Merge returns the union of both accesses.
+func (a Access) Merge(b Access) Access {
+	return Access{
+		cmpReads:  append(slices.Clip(a.cmpReads), b.cmpReads...),
+		cmpWrites: append(slices.Clip(a.cmpWrites), b.cmpWrites...),
+		resReads:  append(slices.Clip(a.resReads), b.resReads...),
+		resWrites: append(slices.Clip(a.resWrites), b.resWrites...),
+	}
+}
+
+// Conflicts reports whether something with access a can't run in parallel with something with access b, because one
+// of them writes what the other reads or writes.
+func (a Access) Conflicts(b Access) bool {
+	return writesConflict(a.cmpWrites, b.cmpReads, b.cmpWrites) ||
+		writesConflict(b.cmpWrites, a.cmpReads, a.cmpWrites) ||
+		writesConflict(a.resWrites, b.resReads, b.resWrites) ||
+		writesConflict(b.resWrites, a.resReads, a.resWrites)
+}
+
+func writesConflict(writes []reflect.Type, others ...[]reflect.Type) bool {
+	for _, w := range writes {
+		for _, other := range others {
+			if slices.Contains(other, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
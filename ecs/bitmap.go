@@ -1,39 +1,111 @@
 package ecs
 
-import "math/bits"
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// inlineWords is the number of bitmap words stored inline, covering the first 128 component ids.
+const inlineWords = 2
+
+// bitmap is a set of component ids. Ids that fit in the inline words don't allocate, larger ids spill into ext which
+// holds the remaining words little endian encoded. ext never ends with a zero word, so equal sets are equal values and
+// bitmaps can be used as map keys.
+type bitmap struct {
+	words [inlineWords]uint64
+	ext   string
+}
+
+func (b bitmap) len() int {
+	return inlineWords + len(b.ext)/8
+}
+
+func (b bitmap) word(idx int) uint64 {
+	if idx < inlineWords {
+		return b.words[idx]
+	}
+	offset := (idx - inlineWords) * 8
+	if offset >= len(b.ext) {
+		return 0
+	}
+	var word uint64
+	for i := 7; i >= 0; i-- {
+		word = word<<8 | uint64(b.ext[offset+i])
+	}
+	return word
+}
+
+func (b bitmap) withWord(idx int, word uint64) bitmap {
+	if idx < inlineWords {
+		b.words[idx] = word
+		return b
+	}
+	ext := []byte(b.ext)
+	offset := (idx - inlineWords) * 8
+	if offset >= len(ext) {
+		if word == 0 {
+			return b
+		}
+		ext = append(ext, make([]byte, offset+8-len(ext))...)
+	}
+	binary.LittleEndian.PutUint64(ext[offset:], word)
+	for len(ext) > 0 && binary.LittleEndian.Uint64(ext[len(ext)-8:]) == 0 {
+		ext = ext[:len(ext)-8]
+	}
+	b.ext = string(ext)
+	return b
+}
 
 func buildBitmap(cmpIds ...componentId) bitmap {
 	var bitmap bitmap
 	for _, cmpId := range cmpIds {
-		bitmap[cmpId/64] |= 1 << (cmpId % 64)
+		bitmap = setBitmap(bitmap, cmpId)
 	}
 	return bitmap
 }
 
 func setBitmap(bitmap bitmap, cmpId componentId) bitmap {
-	bitmap[cmpId/64] |= 1 << (cmpId % 64)
-	return bitmap
+	idx := int(cmpId / 64)
+	return bitmap.withWord(idx, bitmap.word(idx)|1<<(cmpId%64))
 }
 
 func clearBitmap(bitmap bitmap, cmpId componentId) bitmap {
-	bitmap[cmpId/64] &^= 1 << (cmpId % 64)
-	return bitmap
+	idx := int(cmpId / 64)
+	return bitmap.withWord(idx, bitmap.word(idx)&^(1<<(cmpId%64)))
+}
+
+func bitmapHas(bitmap bitmap, cmpId componentId) bool {
+	return bitmap.word(int(cmpId/64))&(1<<(cmpId%64)) != 0
 }
 
 func bitmapIsSubset(a, b bitmap) bool {
-	for key, aValue := range a {
-		bValue := b[key]
-		if aValue&^bValue != 0 {
+	if a.words[0]&^b.words[0] != 0 || a.words[1]&^b.words[1] != 0 {
+		return false
+	}
+	for idx := inlineWords; idx < a.len(); idx++ {
+		if a.word(idx)&^b.word(idx) != 0 {
 			return false
 		}
 	}
 	return true
 }
 
+func bitmapIntersects(a, b bitmap) bool {
+	if a.words[0]&b.words[0] != 0 || a.words[1]&b.words[1] != 0 {
+		return true
+	}
+	for idx := inlineWords; idx < min(a.len(), b.len()); idx++ {
+		if a.word(idx)&b.word(idx) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func extractBitmapCmps(b bitmap) []componentId {
 	var cmpIds []componentId
-	for index, word := range b {
-		tempWord := word
+	for index := 0; index < b.len(); index++ {
+		tempWord := b.word(index)
 		for tempWord != 0 {
 			tz := bits.TrailingZeros64(tempWord)
 			cmpId := componentId(uint32(index)*64 + uint32(tz))
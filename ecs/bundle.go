@@ -0,0 +1,61 @@
+package ecs
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Bundle marks a struct as a bundle of components. When a struct embedding Bundle is spawned, each of its other
+// fields is spawned as a separate component instead of the struct itself. Bundles can be nested.
+//
+//	type playerBundle struct {
+//		ecs.Bundle
+//		transform
+//		velocity
+//	}
+type Bundle struct{}
+
+var bundleType = reflect.TypeOf(Bundle{})
+
+func isBundle(t reflect.Type) bool {
+	if t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type == bundleType {
+			return true
+		}
+	}
+	return false
+}
+
+func expandBundles(cmps []any) []any {
+	expanded := make([]any, 0, len(cmps))
+	for _, cmp := range cmps {
+		expanded = expandBundle(cmp, expanded)
+	}
+	return expanded
+}
+
+func expandBundle(cmp any, out []any) []any {
+	t := reflect.TypeOf(cmp)
+	if !isBundle(t) {
+		return append(out, cmp)
+	}
+	// Copy into an addressable value so unexported fields can be read as well.
+	v := reflect.New(t).Elem()
+	v.Set(reflect.ValueOf(cmp))
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type == bundleType {
+			continue
+		}
+		fv := v.Field(i)
+		if !f.IsExported() {
+			fv = reflect.NewAt(f.Type, unsafe.Pointer(fv.UnsafeAddr())).Elem()
+		}
+		out = expandBundle(fv.Interface(), out)
+	}
+	return out
+}
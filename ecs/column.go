@@ -0,0 +1,82 @@
+package ecs
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// column stores the values of a single component type for every entity of an archetype, contiguously in memory.
+type column struct {
+	cmpType reflect.Type
+	// Slice of cmpType
+	data reflect.Value
+	// Change ticks of every row, see ECS.tick
+	added   []uint64
+	changed []uint64
+}
+
+func newColumn(cmpType reflect.Type) *column {
+	return &column{cmpType: cmpType, data: reflect.MakeSlice(reflect.SliceOf(cmpType), 0, 0)}
+}
+
+func (c *column) get(idx int) any {
+	return c.data.Index(idx).Interface()
+}
+
+func (c *column) set(idx int, cmp any, tick uint64) {
+	c.data.Index(idx).Set(reflect.ValueOf(cmp))
+	c.changed[idx] = tick
+}
+
+func (c *column) push(cmp reflect.Value, tick uint64) {
+	c.data = reflect.Append(c.data, cmp)
+	c.added = append(c.added, tick)
+	c.changed = append(c.changed, tick)
+}
+
+// pushFrom copies the row of src, keeping its change ticks.
+func (c *column) pushFrom(src *column, idx int) {
+	c.data = reflect.Append(c.data, src.data.Index(idx))
+	c.added = append(c.added, src.added[idx])
+	c.changed = append(c.changed, src.changed[idx])
+}
+
+func (c *column) swapRemove(idx int) {
+	last := c.data.Len() - 1
+	if idx != last {
+		c.data.Index(idx).Set(c.data.Index(last))
+		c.added[idx] = c.added[last]
+		c.changed[idx] = c.changed[last]
+	}
+	c.data.Index(last).SetZero()
+	c.data = c.data.Slice(0, last)
+	c.added = c.added[:last]
+	c.changed = c.changed[:last]
+}
+
+// markChanged stamps the rows from start to end as changed on tick.
+func (c *column) markChanged(start int, end int, tick uint64) {
+	if c == nil {
+		return
+	}
+	for i := start; i < end; i++ {
+		c.changed[i] = tick
+	}
+}
+
+// columnSlice views the column as a typed slice. The slice is only valid until the next structural change of the
+// archetype.
+func columnSlice[C any](c *column) []C {
+	if c == nil {
+		return nil
+	}
+	return unsafe.Slice((*C)(c.data.UnsafePointer()), c.data.Len())
+}
+
+// columnRange views the rows from start to end of the column as a typed slice, see columnSlice.
+func columnRange[C any](c *column, start int, end int) []C {
+	if c == nil {
+		return nil
+	}
+	return columnSlice[C](c)[start:end]
+}
@@ -0,0 +1,163 @@
+package ecs
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+type command = func(ecs *ECS) error
+
+// Commands records structural changes, to be applied to the world later at a point where nothing iterates it.
+// Entities spawned through Commands get their handle right away, but only become alive once the buffer is applied.
+// Commands are applied in the order they were recorded.
+type Commands struct {
+	ecs      *ECS
+	commands []command
+	mu       sync.Mutex
+}
+
+// NewCommands initializes an empty command buffer for the world.
+func NewCommands(ecs *ECS) *Commands {
+	return &Commands{ecs: ecs}
+}
+
+func (c *Commands) push(cmd command) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands = append(c.commands, cmd)
+}
+
+// Spawn reserves a new entity and records spawning it with the passed in components.
+func (c *Commands) Spawn(cmps ...any) (Entity, error) {
+	cmps = expandBundles(cmps)
+	bitmap, err := c.ecs.buildCmpsBitmap(cmps)
+	if err != nil {
+		return Entity{}, err
+	}
+	entity := c.ecs.allocator.alloc()
+	c.push(func(ecs *ECS) error {
+		return ecs.spawnReserved([]Entity{entity}, bitmap, cmps)
+	})
+	return entity, nil
+}
+
+// SpawnBatch reserves n new entities and records spawning them with the passed in components.
+func (c *Commands) SpawnBatch(n int, cmps ...any) ([]Entity, error) {
+	cmps = expandBundles(cmps)
+	bitmap, err := c.ecs.buildCmpsBitmap(cmps)
+	if err != nil {
+		return nil, err
+	}
+	entities, err := c.ecs.reserve(n)
+	if err != nil {
+		return nil, err
+	}
+	c.push(func(ecs *ECS) error {
+		return ecs.spawnReserved(entities, bitmap, cmps)
+	})
+	return entities, nil
+}
+
+// SpawnTemplate reserves n new entities and records spawning them from the template.
+func (c *Commands) SpawnTemplate(t *Template, n int, overrides ...any) ([]Entity, error) {
+	if t.ecs != c.ecs {
+		return nil, errors.New("Template belongs to another world")
+	}
+	entities, err := c.ecs.reserve(n)
+	if err != nil {
+		return nil, err
+	}
+	c.push(func(ecs *ECS) error {
+		return ecs.spawnTemplate(entities, t, overrides)
+	})
+	return entities, nil
+}
+
+// Destroy records destroying the entity.
+func (c *Commands) Destroy(entity Entity) error {
+	c.push(func(ecs *ECS) error {
+		return ecs.Destroy(entity)
+	})
+	return nil
+}
+
+// IsAlive reports whether the entity is currently alive in the world. Entities spawned through the buffer are not alive
+// until it is applied.
+func (c *Commands) IsAlive(entity Entity) bool {
+	return c.ecs.IsAlive(entity)
+}
+
+// AddComponent records adding the component to the entity.
+func (c *Commands) AddComponent(entity Entity, cmp any) error {
+	if reflect.TypeOf(cmp) == nil {
+		return errors.New("Component can not be nil")
+	}
+	c.push(func(ecs *ECS) error {
+		return ecs.AddComponent(entity, cmp)
+	})
+	return nil
+}
+
+// RemoveComponent records removing the component from the entity.
+func (c *Commands) RemoveComponent(entity Entity, cmp any) error {
+	if reflect.TypeOf(cmp) == nil {
+		return errors.New("Component can not be nil")
+	}
+	c.push(func(ecs *ECS) error {
+		return ecs.RemoveComponent(entity, cmp)
+	})
+	return nil
+}
+
+// SetParent records making child a child of parent.
+func (c *Commands) SetParent(child Entity, parent Entity) error {
+	c.push(func(ecs *ECS) error {
+		return ecs.SetParent(child, parent)
+	})
+	return nil
+}
+
+// RemoveParent records detaching child from its parent.
+func (c *Commands) RemoveParent(child Entity) error {
+	c.push(func(ecs *ECS) error {
+		return ecs.RemoveParent(child)
+	})
+	return nil
+}
+
+// DestroyRecursive records destroying the entity and all of its descendants.
+func (c *Commands) DestroyRecursive(entity Entity) error {
+	c.push(func(ecs *ECS) error {
+		return ecs.DestroyRecursive(entity)
+	})
+	return nil
+}
+
+// World returns the world the buffer applies to.
+func (c *Commands) World() *ECS {
+	return c.ecs
+}
+
+// Len returns the number of recorded commands.
+func (c *Commands) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.commands)
+}
+
+// Apply applies all recorded commands to the world in order and clears the buffer. Failing commands don't stop the
+// rest from being applied, their errors are joined.
+func (c *Commands) Apply() error {
+	c.mu.Lock()
+	commands := c.commands
+	c.commands = nil
+	c.mu.Unlock()
+	var errs []error
+	for _, cmd := range commands {
+		if err := cmd(c.ecs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
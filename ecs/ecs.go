@@ -2,256 +2,435 @@ package ecs
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"sync"
 	"sync/atomic"
 )
 
-type componentId = uint32
-
-var (
-	cmpIdInc componentId
-	cmpIdMap sync.Map
-)
-
-const MAX_COMPONENTS uint8 = 128
-
-type bitmap = [MAX_COMPONENTS / 64]uint64
-
 type archetype struct {
-	bitmap     bitmap
-	entities   [][]any
+	bitmap bitmap
+	ids    []Entity
+	// One column per component, ordered by component id
+	columns    []*column
 	cmpIndices map[componentId]int
-	mu         sync.Mutex
 }
 
-type entity = uint64
+// Entity is a handle to an entity in the world. Once an entity is destroyed its handle is never valid again, even
+// after its index gets reused by a newly spawned entity. The zero value is never alive.
+type Entity struct {
+	index      uint32
+	generation uint32
+}
 
-var entityIdInc entity
+func (e Entity) String() string {
+	return fmt.Sprintf("Entity(%dv%d)", e.index, e.generation)
+}
 
-type entityRef struct {
-	idx    int
-	bitmap bitmap
-	row    []any
+type entityRecord struct {
+	generation uint32
+	alive      bool
+	archetype  int
+	row        int
 }
 
 type ECS struct {
-	archetypes     []archetype
-	archetypeIndex sync.Map
-	entityIndex    sync.Map
-	// For archetypes array
-	mu sync.RWMutex
+	registry       *Registry
+	allocator      *EntityAllocator
+	archetypes     []*archetype
+	archetypeIndex map[bitmap]int
+	queries        map[string]*queryState
+	// Indexed by entity index
+	entities []entityRecord
+	// For archetypes and entities
+	mu          sync.RWMutex
+	resources   map[reflect.Type]*resource
+	resourcesMu sync.RWMutex
+	events      map[reflect.Type]eventUpdater
+	// Removals of component ids that have a RemovedComponents reader, also registered in events
+	removed  map[componentId]*eventQueue[Entity]
+	eventsMu sync.RWMutex
+	// Incremented on every change, so changes can be ordered relative to the last run of a query
+	tick atomic.Uint64
 }
 
-func New() ECS {
+func New(opts ...Option) ECS {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.registry == nil {
+		o.registry = NewRegistry()
+	}
+	if o.allocator == nil {
+		o.allocator = NewEntityAllocator()
+	}
 	return ECS{
-		archetypes: make([]archetype, 0),
+		registry:       o.registry,
+		allocator:      o.allocator,
+		archetypes:     make([]*archetype, 0),
+		archetypeIndex: make(map[bitmap]int),
+		queries:        make(map[string]*queryState),
+		resources:      make(map[reflect.Type]*resource),
+		events:         make(map[reflect.Type]eventUpdater),
+		removed:        make(map[componentId]*eventQueue[Entity]),
 	}
 }
 
-func (ecs *ECS) Spawn(cmp any) (entity, error) {
-	id := atomic.AddUint64(&entityIdInc, 1)
-	cmpId, err := getCmpId(cmp)
+// World returns the world itself. It lets typed queries and other helpers that take an *ECS reach the world through a
+// SystemCtx.
+func (ecs *ECS) World() *ECS {
+	return ecs
+}
+
+func (ecs *ECS) Spawn(cmps ...any) (Entity, error) {
+	entities, err := ecs.SpawnBatch(1, cmps...)
+	if err != nil {
+		return Entity{}, err
+	}
+	return entities[0], nil
+}
+
+func (ecs *ECS) SpawnBatch(n int, cmps ...any) ([]Entity, error) {
+	cmps = expandBundles(cmps)
+	bitmap, err := ecs.buildCmpsBitmap(cmps)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	bitmap := buildBitmap(cmpId)
-	ref, err := ecs.insertRow(id, bitmap, cmp)
+	entities, err := ecs.reserve(n)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	ecs.entityIndex.Store(id, ref)
-	return id, nil
+	err = ecs.spawnReserved(entities, bitmap, cmps)
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
 }
 
-func (ecs *ECS) Destroy(entity entity) error {
-	refVal, ok := ecs.entityIndex.LoadAndDelete(entity)
-	if !ok {
-		return errors.New("Entity not found")
+// reserve hands out n entities from the allocator, to be spawned later.
+func (ecs *ECS) reserve(n int) ([]Entity, error) {
+	if n < 0 {
+		return nil, errors.New("Number of entities can not be negative")
+	}
+	entities := make([]Entity, n)
+	for i := range entities {
+		entities[i] = ecs.allocator.alloc()
+	}
+	return entities, nil
+}
+
+// spawnReserved inserts entities already handed out by the allocator into the archetype of the bitmap.
+func (ecs *ECS) spawnReserved(entities []Entity, bitmap bitmap, cmps []any) error {
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	tick := ecs.nextTick()
+	aIdx := ecs.ensureArchetype(bitmap)
+	row, err := ecs.buildRow(ecs.archetypes[aIdx], cmps)
+	if err != nil {
+		for _, entity := range entities {
+			ecs.allocator.release(entity)
+		}
+		return err
+	}
+	for _, entity := range entities {
+		ecs.trackEntity(entity)
+		ecs.appendRow(entity, aIdx, row, tick)
 	}
-	ref := refVal.(entityRef)
-	ecs.deleteRow(ref.bitmap, ref.idx)
 	return nil
 }
 
-func (ecs *ECS) AddComponent(entity entity, cmp any) error {
-	refVal, ok := ecs.entityIndex.Load(entity)
+func (ecs *ECS) Destroy(entity Entity) error {
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	rec, ok := ecs.record(entity)
 	if !ok {
 		return errors.New("Entity not found")
 	}
-	ref := refVal.(entityRef)
-	cmpId, err := getCmpId(cmp)
-	if err != nil {
+	ecs.unlink(entity)
+	ecs.sendRemovedAll(entity, ecs.archetypes[rec.archetype])
+	ecs.deleteRow(rec.archetype, rec.row)
+	ecs.freeEntity(entity)
+	return nil
+}
+
+// IsAlive reports whether the entity handle still points to a spawned entity.
+func (ecs *ECS) IsAlive(entity Entity) bool {
+	ecs.mu.RLock()
+	defer ecs.mu.RUnlock()
+	_, ok := ecs.record(entity)
+	return ok
+}
+
+func (ecs *ECS) AddComponent(entity Entity, cmp any) error {
+	if err := checkMaintained(reflect.TypeOf(cmp)); err != nil {
 		return err
 	}
-	bitmap := setBitmap(ref.bitmap, cmpId)
-	cmps := append(ref.row, cmp)
-	newRef, err := ecs.insertRow(entity, bitmap, cmps...)
+	cmpId, err := ecs.registry.id(reflect.TypeOf(cmp))
 	if err != nil {
 		return err
 	}
-	ecs.entityIndex.Store(entity, newRef)
-	ecs.deleteRow(ref.bitmap, ref.idx)
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	rec, ok := ecs.record(entity)
+	if !ok {
+		return errors.New("Entity not found")
+	}
+	old := ecs.archetypes[rec.archetype]
+	if _, ok := old.cmpIndices[cmpId]; ok {
+		return errors.New("Duplicate component")
+	}
+	bitmap := setBitmap(old.bitmap, cmpId)
+	ecs.moveEntity(entity, rec, bitmap, cmpId, reflect.ValueOf(cmp))
 	return nil
 }
 
-func (ecs *ECS) RemoveComponent(entity entity, cmp any) error {
-	refVal, ok := ecs.entityIndex.Load(entity)
-	if !ok {
-		return errors.New("Entity not found")
+func (ecs *ECS) RemoveComponent(entity Entity, cmp any) error {
+	if err := checkMaintained(reflect.TypeOf(cmp)); err != nil {
+		return err
 	}
-	ref := refVal.(entityRef)
-	cmpId, err := getCmpId(cmp)
+	cmpId, err := ecs.registry.id(reflect.TypeOf(cmp))
 	if err != nil {
 		return err
 	}
-	bitmap := clearBitmap(ref.bitmap, cmpId)
-	cmpIdx := len(ref.row)
-	for idx, cmp := range ref.row {
-		rowCmpId, err := getCmpId(cmp)
-		if err != nil {
-			return err
-		}
-		if rowCmpId == cmpId {
-			cmpIdx = idx
-			break
-		}
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	rec, ok := ecs.record(entity)
+	if !ok {
+		return errors.New("Entity not found")
 	}
-	cmps := append(ref.row[0:cmpIdx], ref.row[cmpIdx+1:len(ref.row)]...)
-	newRef, err := ecs.insertRow(entity, bitmap, cmps...)
-	if err != nil {
-		return err
+	old := ecs.archetypes[rec.archetype]
+	if _, ok := old.cmpIndices[cmpId]; !ok {
+		return errors.New("Entity does not have component")
 	}
-	ecs.entityIndex.Store(entity, newRef)
-	ecs.deleteRow(ref.bitmap, ref.idx)
+	bitmap := clearBitmap(old.bitmap, cmpId)
+	ecs.moveEntity(entity, rec, bitmap, cmpId, reflect.Value{})
+	ecs.sendRemoved(cmpId, entity)
 	return nil
 }
 
 func (ecs *ECS) Query(cmps ...any) (func(yield func(QueryResult) bool), error) {
-	cmpIds := make([]uint32, len(cmps))
+	cmpTypes := make([]reflect.Type, len(cmps))
 	for i, cmp := range cmps {
-		cmpId, err := getCmpId(cmp)
-		if err != nil {
-			return nil, err
-		}
-		cmpIds[i] = cmpId
+		cmpTypes[i] = reflect.TypeOf(cmp)
+	}
+	state, err := ecs.prepareQuery(cmpTypes, nil)
+	if err != nil {
+		return nil, err
 	}
-	queryBitmap := buildBitmap(cmpIds...)
 	return func(yield func(QueryResult) bool) {
-		for i := range ecs.archetypes {
-			a := &ecs.archetypes[i]
-			if !bitmapIsSubset(queryBitmap, a.bitmap) {
-				continue
-			}
-			for idx := range a.entities {
-				components := a.entities[idx]
+		tick := ecs.nextTick()
+		state.each(0, func(m queryMatch, start int, end int) bool {
+			for idx := start; idx < end; idx++ {
 				qr := QueryResult{
-					components:   components,
-					cmpIndices:   a.cmpIndices,
-					archetype:    a,
-					archetypeIdx: idx,
+					registry:  ecs.registry,
+					archetype: m.archetype,
+					row:       idx,
+					tick:      tick,
 				}
 				if !yield(qr) {
-					return
+					return false
 				}
 			}
-		}
+			return true
+		})
 	}, nil
 }
 
-func (ecs *ECS) deleteRow(bitmap bitmap, idx int) {
-	a := ecs.ensureArchetype(bitmap)
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.entities = append(a.entities[0:idx], a.entities[idx+1:len(a.entities)]...)
+// nextTick returns a new change tick, later than every tick returned before.
+func (ecs *ECS) nextTick() uint64 {
+	return ecs.tick.Add(1)
+}
+
+// record returns the bookkeeping of a live entity. Must be called with mu held.
+func (ecs *ECS) record(entity Entity) (*entityRecord, bool) {
+	if int(entity.index) >= len(ecs.entities) {
+		return nil, false
+	}
+	rec := &ecs.entities[entity.index]
+	if !rec.alive || rec.generation != entity.generation {
+		return nil, false
+	}
+	return rec, true
+}
+
+// trackEntity marks an allocated entity alive in the world. Must be called with mu held.
+func (ecs *ECS) trackEntity(entity Entity) {
+	if int(entity.index) >= len(ecs.entities) {
+		ecs.entities = append(ecs.entities, make([]entityRecord, int(entity.index)-len(ecs.entities)+1)...)
+	}
+	ecs.entities[entity.index] = entityRecord{generation: entity.generation, alive: true}
+}
+
+func (ecs *ECS) freeEntity(entity Entity) {
+	ecs.entities[entity.index].alive = false
+	ecs.allocator.release(entity)
+}
+
+// moveEntity moves the entity out of its current row and into the archetype of the passed in bitmap. Components
+// shared by both archetypes are copied over, cmp is used for the component with cmpId if it is valid. It reports false
+// without moving the entity if it already is in that archetype.
+func (ecs *ECS) moveEntity(entity Entity, rec *entityRecord, bitmap bitmap, cmpId componentId, cmp reflect.Value) bool {
+	old := ecs.archetypes[rec.archetype]
+	if old.bitmap == bitmap {
+		return false
+	}
+	aIdx := ecs.ensureArchetype(bitmap)
+	a := ecs.archetypes[aIdx]
+	for id, col := range a.cmpIndices {
+		if id == cmpId && cmp.IsValid() {
+			a.columns[col].push(cmp, ecs.nextTick())
+			continue
+		}
+		a.columns[col].pushFrom(old.columns[old.cmpIndices[id]], rec.row)
+	}
+	ecs.deleteRow(rec.archetype, rec.row)
+	a.ids = append(a.ids, entity)
+	rec.archetype = aIdx
+	rec.row = len(a.ids) - 1
+	return true
 }
 
-func (ecs *ECS) insertRow(entity entity, bitmap bitmap, cmps ...any) (entityRef, error) {
-	a := ecs.ensureArchetype(bitmap)
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	row := make([]any, len(cmps))
+// deleteRow swap-removes the row, patching the record of the entity that was moved into its place.
+func (ecs *ECS) deleteRow(aIdx int, idx int) {
+	a := ecs.archetypes[aIdx]
+	for _, col := range a.columns {
+		col.swapRemove(idx)
+	}
+	last := len(a.ids) - 1
+	if idx != last {
+		a.ids[idx] = a.ids[last]
+		ecs.entities[a.ids[idx].index].row = idx
+	}
+	a.ids = a.ids[:last]
+}
+
+// appendRow pushes the row values, ordered by column, into the archetype and points the entity to them.
+func (ecs *ECS) appendRow(entity Entity, aIdx int, row []reflect.Value, tick uint64) {
+	a := ecs.archetypes[aIdx]
+	for col, cmp := range row {
+		a.columns[col].push(cmp, tick)
+	}
+	a.ids = append(a.ids, entity)
+	rec := &ecs.entities[entity.index]
+	rec.archetype = aIdx
+	rec.row = len(a.ids) - 1
+}
+
+func (ecs *ECS) buildRow(a *archetype, cmps []any) ([]reflect.Value, error) {
+	row := make([]reflect.Value, len(cmps))
 	for _, cmp := range cmps {
-		cmpId, err := getCmpId(cmp)
+		cmpId, err := ecs.registry.id(reflect.TypeOf(cmp))
 		if err != nil {
-			return entityRef{}, err
+			return nil, err
 		}
-		idx := a.cmpIndices[cmpId]
-		row[idx] = cmp
+		row[a.cmpIndices[cmpId]] = reflect.ValueOf(cmp)
 	}
-	a.entities = append(a.entities, row)
-	idx := len(a.entities) - 1
-	return entityRef{row: a.entities[idx], idx: idx, bitmap: bitmap}, nil
+	return row, nil
 }
 
-func (ecs *ECS) ensureArchetype(bitmap bitmap) *archetype {
-	idxVal, ok := ecs.archetypeIndex.Load(bitmap)
-	if !ok {
-		ecs.mu.Lock()
-		defer ecs.mu.Unlock()
-		cmpIds := extractBitmapCmps(bitmap)
-		cmpIndices := make(map[componentId]int)
-		for idx, cmpId := range cmpIds {
-			cmpIndices[cmpId] = idx
+func (ecs *ECS) buildCmpsBitmap(cmps []any) (bitmap, error) {
+	var bitmap bitmap
+	for _, cmp := range cmps {
+		if err := checkMaintained(reflect.TypeOf(cmp)); err != nil {
+			return bitmap, err
+		}
+		cmpId, err := ecs.registry.id(reflect.TypeOf(cmp))
+		if err != nil {
+			return bitmap, err
 		}
-		ecs.archetypes = append(ecs.archetypes, archetype{bitmap: bitmap, entities: make([][]any, 0), cmpIndices: cmpIndices})
-		idx := len(ecs.archetypes) - 1
-		idxVal = idx
-		ecs.archetypeIndex.Store(bitmap, idx)
+		if bitmapHas(bitmap, cmpId) {
+			return bitmap, errors.New("Duplicate component")
+		}
+		bitmap = setBitmap(bitmap, cmpId)
 	}
-	idx := idxVal.(int)
-	return &ecs.archetypes[idx]
+	return bitmap, nil
 }
 
-func getCmpId(cmp any) (componentId, error) {
-	cmpType := reflect.TypeOf(cmp)
-	if id, ok := cmpIdMap.Load(cmpType); ok {
-		return id.(componentId), nil
+// ensureArchetype returns the index of the archetype matching the bitmap, creating it if needed. Must be called with
+// mu held.
+func (ecs *ECS) ensureArchetype(bitmap bitmap) int {
+	if idx, ok := ecs.archetypeIndex[bitmap]; ok {
+		return idx
+	}
+	cmpIds := extractBitmapCmps(bitmap)
+	a := &archetype{
+		bitmap:     bitmap,
+		columns:    make([]*column, len(cmpIds)),
+		cmpIndices: make(map[componentId]int),
+	}
+	for idx, cmpId := range cmpIds {
+		a.cmpIndices[cmpId] = idx
+		a.columns[idx] = newColumn(ecs.registry.typeOf(cmpId))
 	}
-	if cmpIdInc >= uint32(MAX_COMPONENTS) {
-		return 0, errors.New("Max number of components")
+	ecs.archetypes = append(ecs.archetypes, a)
+	idx := len(ecs.archetypes) - 1
+	ecs.archetypeIndex[bitmap] = idx
+	for _, state := range ecs.queries {
+		state.track(a)
 	}
-	id := atomic.AddUint32(&cmpIdInc, 1)
-	cmpIdMap.Store(cmpType, id)
-	return id, nil
+	return idx
 }
 
 type QueryResult struct {
-	components   []any
-	cmpIndices   map[componentId]int
-	archetype    *archetype
-	archetypeIdx int
+	registry  *Registry
+	archetype *archetype
+	row       int
+	// Changes made through the result are stamped with it
+	tick uint64
+}
+
+// Entity returns the entity the query result belongs to.
+func (qr *QueryResult) Entity() Entity {
+	return qr.archetype.ids[qr.row]
 }
 
 func GetComponent[C any](qr *QueryResult) (C, error) {
 	var zero C
-	cmpId, err := getCmpId(zero)
+	cmpId, err := qr.registry.id(reflect.TypeFor[C]())
 	if err != nil {
 		return zero, err
 	}
-	idx, ok := qr.cmpIndices[cmpId]
+	idx, ok := qr.archetype.cmpIndices[cmpId]
 	if !ok {
 		return zero, errors.New("Component in type param does not exist in this query result")
 	}
-	if _, ok := qr.components[idx].(C); !ok {
-		panic("Improperly mapped cmp indices")
+	return columnSlice[C](qr.archetype.columns[idx])[qr.row], nil
+}
+
+// GetMut returns a pointer to the component in the world's storage and marks it changed, so it can be updated in place
+// without writing it back with SetComponent. The pointer is only valid until the next structural change, such as
+// spawning or destroying entities or adding or removing components, and must not be kept around after the iteration
+// that yielded the query result. Parent and Children can't be changed this way.
+func GetMut[C any](qr *QueryResult) (*C, error) {
+	if err := checkMaintained(reflect.TypeFor[C]()); err != nil {
+		return nil, err
+	}
+	cmpId, err := qr.registry.id(reflect.TypeFor[C]())
+	if err != nil {
+		return nil, err
 	}
-	component, ok := qr.components[idx].(C)
+	idx, ok := qr.archetype.cmpIndices[cmpId]
 	if !ok {
-		return zero, errors.New("Component type does not match expected type")
+		return nil, errors.New("Component in type param does not exist in this query result")
 	}
-	return component, nil
+	col := qr.archetype.columns[idx]
+	col.markChanged(qr.row, qr.row+1, qr.tick)
+	return &columnSlice[C](col)[qr.row], nil
 }
 
 func SetComponent(qr *QueryResult, cmp any) error {
-	cmpId, err := getCmpId(cmp)
+	if err := checkMaintained(reflect.TypeOf(cmp)); err != nil {
+		return err
+	}
+	cmpId, err := qr.registry.id(reflect.TypeOf(cmp))
 	if err != nil {
 		return err
 	}
-	idx, ok := qr.cmpIndices[cmpId]
+	idx, ok := qr.archetype.cmpIndices[cmpId]
 	if !ok {
 		return errors.New("Component does not exist in this query result")
 	}
-	qr.archetype.entities[qr.archetypeIdx][idx] = cmp
+	qr.archetype.columns[idx].set(qr.row, cmp, qr.tick)
 	return nil
 }
@@ -1,6 +1,12 @@
 package ecs
 
 import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,13 +22,158 @@ func TestEcs(t *testing.T) {
 		ecs := New()
 		id, err := ecs.Spawn(5)
 		assert.NoError(t, err)
-		entityVal, ok := ecs.entityIndex.Load(id)
-		entity := entityVal.(entityRef)
-		assert.True(t, ok)
-		assert.Equal(t, entity.row[0].(int), 5)
+		assert.True(t, ecs.IsAlive(id))
+		rec := ecs.entities[id.index]
+		assert.Equal(t, ecs.archetypes[rec.archetype].columns[0].get(rec.row).(int), 5)
+		assert.Len(t, ecs.archetypes, 1)
+		assert.Len(t, ecs.archetypes[0].ids, 1)
+		assert.Equal(t, ecs.archetypes[0].columns[0].get(0).(int), 5)
+	})
+
+	t.Run("spawns entity with multiple components", func(t *testing.T) {
+		ecs := New()
+		_, err := ecs.Spawn(5, transform{x: 10, y: 5})
+		assert.NoError(t, err)
+		assert.Len(t, ecs.archetypes, 1)
+		assert.Len(t, ecs.archetypes[0].ids, 1)
+		assert.Equal(t, ecs.archetypes[0].columns[0].get(0).(int), 5)
+		assert.Equal(t, ecs.archetypes[0].columns[1].get(0).(transform).x, 10)
+
+		_, err = ecs.Spawn(5, 6)
+		assert.Error(t, err)
+	})
+
+	t.Run("spawns bundle", func(t *testing.T) {
+		type inner struct {
+			Bundle
+			name string
+		}
+		type outer struct {
+			Bundle
+			transform
+			inner
+			hp int
+		}
+		ecs := New()
+		_, err := ecs.Spawn(outer{transform: transform{x: 1, y: 2}, inner: inner{name: "a"}, hp: 3})
+		assert.NoError(t, err)
+		assert.Len(t, ecs.archetypes, 1)
+		assert.Len(t, ecs.archetypes[0].cmpIndices, 3)
+		iter, err := ecs.Query(transform{}, "", 0)
+		assert.NoError(t, err)
+		count := 0
+		for res := range iter {
+			name, err := GetComponent[string](&res)
+			assert.NoError(t, err)
+			assert.Equal(t, "a", name)
+			hp, err := GetComponent[int](&res)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, hp)
+			count++
+		}
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("spawns batch", func(t *testing.T) {
+		ecs := New()
+		ids, err := ecs.SpawnBatch(10, 5, transform{x: 1})
+		assert.NoError(t, err)
+		assert.Len(t, ids, 10)
+		assert.Len(t, ecs.archetypes, 1)
+		assert.Len(t, ecs.archetypes[0].ids, 10)
+		err = ecs.Destroy(ids[9])
+		assert.NoError(t, err)
+		assert.Len(t, ecs.archetypes[0].ids, 9)
+
+		_, err = ecs.SpawnBatch(-1, 5)
+		assert.EqualError(t, err, "Number of entities can not be negative")
+	})
+
+	t.Run("spawns templates", func(t *testing.T) {
+		ecs := New()
+		tmpl, err := NewTemplate(&ecs, 5, transform{x: 1})
+		assert.NoError(t, err)
+		ids, err := ecs.SpawnTemplate(tmpl, 3)
+		assert.NoError(t, err)
+		assert.Len(t, ids, 3)
 		assert.Len(t, ecs.archetypes, 1)
-		assert.Len(t, ecs.archetypes[0].entities, 1)
-		assert.Equal(t, ecs.archetypes[0].entities[0][0].(int), 5)
+		assert.Len(t, ecs.archetypes[0].ids, 3)
+
+		ids, err = ecs.SpawnTemplate(tmpl, 2, transform{x: 2}, "extra")
+		assert.NoError(t, err)
+		assert.Len(t, ecs.archetypes, 2)
+		q, err := NewQuery2[int, transform](&ecs)
+		assert.NoError(t, err)
+		row, ok := q.Get(ids[1])
+		assert.True(t, ok)
+		assert.Equal(t, 5, *row.C1)
+		assert.Equal(t, transform{x: 2}, *row.C2)
+
+		other := New()
+		_, err = other.SpawnTemplate(tmpl, 1)
+		assert.EqualError(t, err, "Template belongs to another world")
+		_, err = ecs.SpawnTemplate(tmpl, -1)
+		assert.EqualError(t, err, "Number of entities can not be negative")
+	})
+
+	t.Run("isolates worlds", func(t *testing.T) {
+		a := New()
+		b := New()
+		_, err := a.Spawn(5)
+		assert.NoError(t, err)
+		_, err = b.Spawn(transform{})
+		assert.NoError(t, err)
+		assert.Len(t, a.registry.types, 1)
+		assert.Len(t, b.registry.types, 1)
+		assert.Equal(t, a.archetypes[0].bitmap, b.archetypes[0].bitmap)
+	})
+
+	t.Run("shares registry and allocator explicitly", func(t *testing.T) {
+		registry := NewRegistry()
+		allocator := NewEntityAllocator()
+		a := New(WithRegistry(registry), WithEntityAllocator(allocator))
+		b := New(WithRegistry(registry), WithEntityAllocator(allocator))
+		e1, err := a.Spawn(5)
+		assert.NoError(t, err)
+		e2, err := b.Spawn(transform{})
+		assert.NoError(t, err)
+		assert.NotEqual(t, e1, e2)
+		assert.True(t, a.IsAlive(e1))
+		assert.False(t, a.IsAlive(e2))
+		assert.True(t, b.IsAlive(e2))
+		assert.Len(t, registry.types, 2)
+		assert.NotEqual(t, a.archetypes[0].bitmap, b.archetypes[0].bitmap)
+	})
+
+	t.Run("registers thousands of components", func(t *testing.T) {
+		ecs := New()
+		markers := make([]any, 5000)
+		for i := range markers {
+			markers[i] = reflect.New(reflect.ArrayOf(i, reflect.TypeFor[bool]())).Elem().Interface()
+			_, err := ecs.Spawn(transform{x: i}, markers[i])
+			assert.NoError(t, err)
+		}
+		wide, err := ecs.Spawn(markers[4000:4200]...)
+		assert.NoError(t, err)
+		assert.Len(t, ecs.registry.types, 5001)
+		assert.Len(t, ecs.archetypes, 5001)
+
+		iter, err := ecs.Query(transform{}, markers[4999])
+		assert.NoError(t, err)
+		for res := range iter {
+			cmp, err := GetComponent[transform](&res)
+			assert.NoError(t, err)
+			assert.Equal(t, 4999, cmp.x)
+		}
+		iter, err = ecs.Query(markers[4100], markers[4199])
+		assert.NoError(t, err)
+		for res := range iter {
+			assert.Equal(t, wide, res.Entity())
+		}
+
+		assert.NoError(t, ecs.RemoveComponent(wide, markers[4199]))
+		assert.NoError(t, ecs.AddComponent(wide, markers[4199]))
+		assert.Len(t, ecs.archetypes, 5002)
 	})
 
 	t.Run("destroys entity", func(t *testing.T) {
@@ -31,10 +182,44 @@ func TestEcs(t *testing.T) {
 		assert.NoError(t, err)
 		err = ecs.Destroy(id)
 		assert.NoError(t, err)
-		_, ok := ecs.entityIndex.Load(id)
-		assert.False(t, ok)
+		assert.False(t, ecs.IsAlive(id))
 		assert.Len(t, ecs.archetypes, 1)
-		assert.Len(t, ecs.archetypes[0].entities, 0)
+		assert.Len(t, ecs.archetypes[0].ids, 0)
+		assert.Error(t, ecs.Destroy(id))
+	})
+
+	t.Run("rejects stale entities", func(t *testing.T) {
+		ecs := New()
+		stale, err := ecs.Spawn(5)
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.Destroy(stale))
+		reused, err := ecs.Spawn(6)
+		assert.NoError(t, err)
+		assert.Equal(t, stale.index, reused.index)
+		assert.NotEqual(t, stale, reused)
+		assert.False(t, ecs.IsAlive(stale))
+		assert.True(t, ecs.IsAlive(reused))
+		assert.Error(t, ecs.AddComponent(stale, transform{}))
+		assert.Error(t, ecs.Destroy(stale))
+		assert.True(t, ecs.IsAlive(reused))
+	})
+
+	t.Run("keeps other entities intact when deleting rows", func(t *testing.T) {
+		ecs := New()
+		ids, err := ecs.SpawnBatch(3, 5)
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.Destroy(ids[0]))
+		assert.NoError(t, ecs.AddComponent(ids[2], transform{x: 1}))
+		assert.NoError(t, ecs.AddComponent(ids[1], transform{x: 2}))
+		iter, err := ecs.Query(transform{})
+		assert.NoError(t, err)
+		found := map[Entity]int{}
+		for res := range iter {
+			cmp, err := GetComponent[transform](&res)
+			assert.NoError(t, err)
+			found[res.Entity()] = cmp.x
+		}
+		assert.Equal(t, map[Entity]int{ids[1]: 2, ids[2]: 1}, found)
 	})
 
 	t.Run("adds component", func(t *testing.T) {
@@ -44,11 +229,11 @@ func TestEcs(t *testing.T) {
 		err = ecs.AddComponent(id, transform{x: 10, y: 5})
 		assert.NoError(t, err)
 		assert.Len(t, ecs.archetypes, 2)
-		assert.Len(t, ecs.archetypes[0].entities, 0)
-		assert.Len(t, ecs.archetypes[1].entities, 1)
-		assert.Equal(t, ecs.archetypes[1].entities[0][0].(int), 5)
-		assert.Equal(t, ecs.archetypes[1].entities[0][1].(transform).x, 10)
-		assert.Equal(t, ecs.archetypes[1].entities[0][1].(transform).y, 5)
+		assert.Len(t, ecs.archetypes[0].ids, 0)
+		assert.Len(t, ecs.archetypes[1].ids, 1)
+		assert.Equal(t, ecs.archetypes[1].columns[0].get(0).(int), 5)
+		assert.Equal(t, ecs.archetypes[1].columns[1].get(0).(transform).x, 10)
+		assert.Equal(t, ecs.archetypes[1].columns[1].get(0).(transform).y, 5)
 	})
 
 	t.Run("removes component", func(t *testing.T) {
@@ -59,9 +244,9 @@ func TestEcs(t *testing.T) {
 		assert.NoError(t, err)
 		err = ecs.RemoveComponent(id, transform{})
 		assert.NoError(t, err)
-		assert.Len(t, ecs.archetypes[0].entities, 1)
-		assert.Len(t, ecs.archetypes[1].entities, 0)
-		assert.Equal(t, ecs.archetypes[0].entities[0][0].(int), 5)
+		assert.Len(t, ecs.archetypes[0].ids, 1)
+		assert.Len(t, ecs.archetypes[1].ids, 0)
+		assert.Equal(t, ecs.archetypes[0].columns[0].get(0).(int), 5)
 	})
 
 	t.Run("queries components", func(t *testing.T) {
@@ -79,6 +264,839 @@ func TestEcs(t *testing.T) {
 			err = SetComponent(&res, 3)
 			assert.NoError(t, err)
 		}
-		assert.Equal(t, ecs.archetypes[0].entities[0][0].(int), 3)
+		assert.Equal(t, ecs.archetypes[0].columns[0].get(0).(int), 3)
+	})
+
+	t.Run("mutates components in place", func(t *testing.T) {
+		type transform struct {
+			x int
+			y int
+		}
+		ecs := New()
+		_, err := ecs.SpawnBatch(2, transform{x: 1}, "tag")
+		assert.NoError(t, err)
+		changed, err := NewQuery1[transform](&ecs, Changed[transform](), ReadOnly[transform]())
+		assert.NoError(t, err)
+		for range changed.Iter() {
+		}
+		iter, err := ecs.Query(transform{})
+		assert.NoError(t, err)
+		for res := range iter {
+			cmp, err := GetMut[transform](&res)
+			assert.NoError(t, err)
+			cmp.x++
+			cmp.y = 4
+			_, err = GetMut[int](&res)
+			assert.Error(t, err)
+		}
+		count := 0
+		for row := range changed.Iter() {
+			assert.Equal(t, transform{x: 2, y: 4}, *row.C1)
+			count++
+		}
+		assert.Equal(t, 2, count)
+	})
+}
+
+func TestCommands(t *testing.T) {
+	type transform struct {
+		x int
+		y int
+	}
+
+	t.Run("defers structural changes until applied", func(t *testing.T) {
+		ecs := New()
+		existing, err := ecs.Spawn(5)
+		assert.NoError(t, err)
+		cmds := NewCommands(&ecs)
+		spawned, err := cmds.Spawn(6, transform{x: 1})
+		assert.NoError(t, err)
+		assert.NoError(t, cmds.AddComponent(spawned, "tag"))
+		assert.NoError(t, cmds.Destroy(existing))
+		assert.Equal(t, 3, cmds.Len())
+		assert.False(t, ecs.IsAlive(spawned))
+		assert.True(t, ecs.IsAlive(existing))
+
+		assert.NoError(t, cmds.Apply())
+		assert.Equal(t, 0, cmds.Len())
+		assert.True(t, ecs.IsAlive(spawned))
+		assert.False(t, ecs.IsAlive(existing))
+		iter, err := ecs.Query(transform{}, "")
+		assert.NoError(t, err)
+		count := 0
+		for res := range iter {
+			assert.Equal(t, spawned, res.Entity())
+			count++
+		}
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("reports failing commands", func(t *testing.T) {
+		ecs := New()
+		cmds := NewCommands(&ecs)
+		entities, err := cmds.SpawnBatch(2, 5)
+		assert.NoError(t, err)
+		assert.NoError(t, cmds.Destroy(entities[0]))
+		assert.NoError(t, cmds.Destroy(entities[0]))
+		assert.Error(t, cmds.Apply())
+		assert.False(t, ecs.IsAlive(entities[0]))
+		assert.True(t, ecs.IsAlive(entities[1]))
+
+		_, err = cmds.SpawnBatch(-1, 5)
+		assert.Error(t, err)
+		_, err = cmds.Spawn(5, 6)
+		assert.Error(t, err)
+	})
+}
+
+func TestResources(t *testing.T) {
+	type score struct {
+		points int
+	}
+
+	t.Run("inserts, mutates and removes resources", func(t *testing.T) {
+		ecs := New()
+		_, err := Resource[score](&ecs)
+		assert.Error(t, err)
+		InsertResource(&ecs, score{points: 1})
+		err = ResourceMut(&ecs, func(s *score) {
+			s.points += 2
+		})
+		assert.NoError(t, err)
+		res, err := Resource[score](&ecs)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, res.points)
+		InsertResource(&ecs, score{points: 10})
+		res, err = Resource[score](&ecs)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, res.points)
+		assert.NoError(t, RemoveResource[score](&ecs))
+		assert.Error(t, RemoveResource[score](&ecs))
+		assert.Error(t, ResourceMut(&ecs, func(*score) {}))
+	})
+
+	t.Run("mutates resources concurrently", func(t *testing.T) {
+		ecs := New()
+		InsertResource(&ecs, score{})
+		var wg sync.WaitGroup
+		for range 100 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = ResourceMut(&ecs, func(s *score) {
+					s.points++
+				})
+				_, _ = Resource[score](&ecs)
+			}()
+		}
+		wg.Wait()
+		res, err := Resource[score](&ecs)
+		assert.NoError(t, err)
+		assert.Equal(t, 100, res.points)
+	})
+}
+
+func TestEvents(t *testing.T) {
+	type collision struct {
+		id int
+	}
+
+	t.Run("reads events once per reader", func(t *testing.T) {
+		ecs := New()
+		damage := NewEventReader[collision](&ecs)
+		SendEvent(&ecs, collision{id: 1})
+		audio := NewEventReader[collision](&ecs)
+		assert.Equal(t, []collision{{id: 1}}, damage.Read())
+		assert.Empty(t, damage.Read())
+		SendEvent(&ecs, collision{id: 2})
+		assert.Equal(t, []collision{{id: 2}}, damage.Read())
+		assert.Equal(t, []collision{{id: 1}, {id: 2}}, audio.Read())
+	})
+
+	t.Run("drops events after a full update", func(t *testing.T) {
+		ecs := New()
+		early := NewEventReader[collision](&ecs)
+		late := NewEventReader[collision](&ecs)
+		SendEvent(&ecs, collision{id: 1})
+		assert.Equal(t, []collision{{id: 1}}, early.Read())
+		ecs.UpdateEvents()
+		SendEvent(&ecs, collision{id: 2})
+		assert.Equal(t, []collision{{id: 2}}, early.Read())
+		ecs.UpdateEvents()
+		assert.Equal(t, []collision{{id: 2}}, late.Read())
+		ecs.UpdateEvents()
+		assert.Empty(t, early.Read())
+		assert.Empty(t, NewEventReader[collision](&ecs).Read())
+	})
+}
+
+func TestTypedQuery(t *testing.T) {
+	type transform struct {
+		x int
+		y int
+	}
+	type velocity struct {
+		x int
+		y int
+	}
+	type frozen struct{}
+	type tag struct{}
+
+	t.Run("yields typed pointers", func(t *testing.T) {
+		ecs := New()
+		moving, err := ecs.Spawn(transform{x: 1}, velocity{x: 2})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 1})
+		assert.NoError(t, err)
+		q, err := NewQuery2[transform, velocity](ecs.World())
+		assert.NoError(t, err)
+		count := 0
+		for row := range q.Iter() {
+			assert.Equal(t, moving, row.Entity)
+			row.C1.x += row.C2.x
+			count++
+		}
+		assert.Equal(t, 1, count)
+		for row := range q.Iter() {
+			assert.Equal(t, 3, row.C1.x)
+		}
+	})
+
+	t.Run("gets single entities", func(t *testing.T) {
+		ecs := New()
+		moving, err := ecs.Spawn(transform{x: 1}, velocity{x: 2})
+		assert.NoError(t, err)
+		still, err := ecs.Spawn(transform{x: 1})
+		assert.NoError(t, err)
+		q, err := NewQuery2[transform, velocity](&ecs, Optional[velocity]())
+		assert.NoError(t, err)
+		row, ok := q.Get(moving)
+		assert.True(t, ok)
+		row.C1.x = 7
+		row, ok = q.Get(moving)
+		assert.True(t, ok)
+		assert.Equal(t, 7, row.C1.x)
+		row, ok = q.Get(still)
+		assert.True(t, ok)
+		assert.Nil(t, row.C2)
+		frozenQuery, err := NewQuery1[transform](&ecs, With[frozen]())
+		assert.NoError(t, err)
+		_, ok = frozenQuery.Get(moving)
+		assert.False(t, ok)
+		assert.NoError(t, ecs.Destroy(moving))
+		_, ok = q.Get(moving)
+		assert.False(t, ok)
+	})
+
+	t.Run("iterates contiguous chunks", func(t *testing.T) {
+		ecs := New()
+		_, err := ecs.SpawnBatch(3, transform{x: 1}, velocity{x: 2})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 5})
+		assert.NoError(t, err)
+		q, err := NewQuery2[transform, velocity](&ecs, Optional[velocity]())
+		assert.NoError(t, err)
+		var lens []int
+		for chunk := range q.Chunks() {
+			lens = append(lens, len(chunk.Entities))
+			assert.Len(t, chunk.C1, len(chunk.Entities))
+			for i := range chunk.C2 {
+				chunk.C1[i].x += chunk.C2[i].x
+			}
+		}
+		assert.ElementsMatch(t, []int{3, 1}, lens)
+		iter, err := ecs.Query(transform{}, velocity{})
+		assert.NoError(t, err)
+		for res := range iter {
+			cmp, err := GetComponent[transform](&res)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, cmp.x)
+		}
+	})
+
+	t.Run("filters with and without", func(t *testing.T) {
+		ecs := New()
+		_, err := ecs.Spawn(transform{x: 1}, tag{})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 2}, tag{}, frozen{})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 3})
+		assert.NoError(t, err)
+		q, err := NewQuery1[transform](&ecs, With[tag](), Without[frozen]())
+		assert.NoError(t, err)
+		var xs []int
+		for row := range q.Iter() {
+			xs = append(xs, row.C1.x)
+		}
+		assert.Equal(t, []int{1}, xs)
+	})
+
+	t.Run("fetches optional components", func(t *testing.T) {
+		ecs := New()
+		_, err := ecs.Spawn(transform{x: 1}, velocity{x: 2})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 3})
+		assert.NoError(t, err)
+		q, err := NewQuery2[transform, velocity](&ecs, Optional[velocity]())
+		assert.NoError(t, err)
+		found := map[int]bool{}
+		for row := range q.Iter() {
+			found[row.C1.x] = row.C2 != nil
+		}
+		assert.Equal(t, map[int]bool{1: true, 3: false}, found)
+
+		_, err = NewQuery1[transform](&ecs, Optional[velocity]())
+		assert.Error(t, err)
+	})
+
+	t.Run("tracks archetypes created after preparing", func(t *testing.T) {
+		ecs := New()
+		q, err := NewQuery1[transform](&ecs)
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 1})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 2}, velocity{})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(velocity{})
+		assert.NoError(t, err)
+		count := 0
+		for range q.Iter() {
+			count++
+		}
+		assert.Equal(t, 2, count)
+		assert.Len(t, q.state.matches, 2)
+
+		cached, err := NewQuery1[transform](&ecs)
+		assert.NoError(t, err)
+		assert.Same(t, q.state, cached.state)
+	})
+
+	t.Run("filters or", func(t *testing.T) {
+		ecs := New()
+		_, err := ecs.Spawn(transform{x: 1}, tag{})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 2}, velocity{})
+		assert.NoError(t, err)
+		_, err = ecs.Spawn(transform{x: 3}, velocity{}, frozen{})
+		assert.NoError(t, err)
+		q, err := NewQuery1[transform](&ecs, Or(With[tag](), Without[frozen]()), With[velocity]())
+		assert.NoError(t, err)
+		var xs []int
+		for row := range q.Iter() {
+			xs = append(xs, row.C1.x)
+		}
+		assert.Equal(t, []int{2}, xs)
+	})
+}
+
+func TestHierarchy(t *testing.T) {
+	type transform struct {
+		x int
+	}
+
+	t.Run("rejects changing hierarchy components directly", func(t *testing.T) {
+		ecs := New()
+		parent, err := ecs.Spawn(transform{x: 0})
+		assert.NoError(t, err)
+		a, err := ecs.Spawn(transform{x: 1})
+		assert.NoError(t, err)
+		b, err := ecs.Spawn(transform{x: 2})
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.SetParent(a, parent))
+		assert.NoError(t, ecs.SetParent(b, parent))
+		assert.EqualError(t, ecs.RemoveComponent(a, Parent{}), "ecs.Parent is maintained by the world, use SetParent and RemoveParent")
+		assert.Error(t, ecs.AddComponent(b, Children{}))
+		_, err = ecs.Spawn(transform{}, Parent{entity: parent})
+		assert.Error(t, err)
+		_, err = ecs.SpawnBatch(2, Children{})
+		assert.Error(t, err)
+		_, err = NewTemplate(&ecs, Parent{})
+		assert.Error(t, err)
+		iter, err := ecs.Query(Children{})
+		assert.NoError(t, err)
+		parents := 0
+		for res := range iter {
+			assert.Error(t, SetComponent(&res, Children{}))
+			_, err := GetMut[Children](&res)
+			assert.Error(t, err)
+			parents++
+		}
+		assert.Equal(t, 1, parents)
+		assert.Equal(t, []Entity{a, b}, ecs.children(parent))
+
+		d, err := ecs.Spawn(transform{x: 4})
+		assert.NoError(t, err)
+		e, err := ecs.Spawn(transform{x: 5})
+		assert.NoError(t, err)
+		// Deleting a component the entity doesn't have must not duplicate its row.
+		ecs.mu.Lock()
+		ecs.deleteComponent(a, reflect.TypeFor[Parent]())
+		ecs.deleteComponent(d, reflect.TypeFor[Parent]())
+		ecs.mu.Unlock()
+		q, err := NewQuery1[transform](&ecs)
+		assert.NoError(t, err)
+		check := func(expected map[Entity]int) {
+			for entity, x := range expected {
+				row, ok := q.Get(entity)
+				assert.True(t, ok)
+				assert.Equal(t, x, row.C1.x)
+			}
+			count := 0
+			for range q.Iter() {
+				count++
+			}
+			assert.Equal(t, len(expected), count)
+		}
+		check(map[Entity]int{parent: 0, a: 1, b: 2, d: 4, e: 5})
+
+		assert.NoError(t, ecs.Destroy(parent))
+		check(map[Entity]int{a: 1, b: 2, d: 4, e: 5})
+		_, ok := ecs.parent(b)
+		assert.False(t, ok)
+	})
+
+	t.Run("maintains parent and children", func(t *testing.T) {
+		ecs := New()
+		entities, err := ecs.SpawnBatch(3, transform{})
+		assert.NoError(t, err)
+		root, a, b := entities[0], entities[1], entities[2]
+		assert.NoError(t, ecs.SetParent(a, root))
+		assert.NoError(t, ecs.SetParent(b, root))
+		assert.Equal(t, []Entity{a, b}, slices.Collect(ecs.Descendants(root)))
+		assert.Equal(t, []Entity{root}, slices.Collect(ecs.Ancestors(b)))
+
+		assert.NoError(t, ecs.SetParent(b, a))
+		assert.Equal(t, []Entity{a, b}, slices.Collect(ecs.Descendants(root)))
+		assert.Equal(t, []Entity{a, root}, slices.Collect(ecs.Ancestors(b)))
+		query, err := NewQuery1[Children](&ecs)
+		assert.NoError(t, err)
+		for row := range query.Iter() {
+			assert.Len(t, row.C1.Entities(), 1)
+		}
+
+		assert.EqualError(t, ecs.SetParent(root, b), "Entity can not be its own ancestor")
+		assert.EqualError(t, ecs.SetParent(a, a), "Entity can not be its own ancestor")
+
+		assert.NoError(t, ecs.RemoveParent(a))
+		assert.Empty(t, slices.Collect(ecs.Descendants(root)))
+		assert.Empty(t, slices.Collect(ecs.Ancestors(a)))
+		assert.EqualError(t, ecs.RemoveParent(a), "Entity does not have a parent")
+		iter, err := ecs.Query(Children{})
+		assert.NoError(t, err)
+		count := 0
+		for range iter {
+			count++
+		}
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("destroys recursively", func(t *testing.T) {
+		ecs := New()
+		entities, err := ecs.SpawnBatch(5, transform{})
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.SetParent(entities[1], entities[0]))
+		assert.NoError(t, ecs.SetParent(entities[2], entities[1]))
+		assert.NoError(t, ecs.SetParent(entities[3], entities[1]))
+		assert.NoError(t, ecs.SetParent(entities[4], entities[0]))
+
+		assert.NoError(t, ecs.DestroyRecursive(entities[1]))
+		for _, entity := range entities[1:4] {
+			assert.False(t, ecs.IsAlive(entity))
+		}
+		assert.True(t, ecs.IsAlive(entities[0]))
+		assert.True(t, ecs.IsAlive(entities[4]))
+		assert.Equal(t, []Entity{entities[4]}, slices.Collect(ecs.Descendants(entities[0])))
+	})
+
+	t.Run("orphans children of destroyed entities", func(t *testing.T) {
+		ecs := New()
+		entities, err := ecs.SpawnBatch(3, transform{})
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.SetParent(entities[1], entities[0]))
+		assert.NoError(t, ecs.SetParent(entities[2], entities[1]))
+		assert.NoError(t, ecs.Destroy(entities[1]))
+		assert.True(t, ecs.IsAlive(entities[2]))
+		assert.Empty(t, slices.Collect(ecs.Ancestors(entities[2])))
+		assert.Empty(t, slices.Collect(ecs.Descendants(entities[0])))
+	})
+
+	t.Run("records hierarchy changes in commands", func(t *testing.T) {
+		ecs := New()
+		cmds := NewCommands(&ecs)
+		parent, err := cmds.Spawn(transform{})
+		assert.NoError(t, err)
+		child, err := cmds.Spawn(transform{x: 1})
+		assert.NoError(t, err)
+		assert.NoError(t, cmds.SetParent(child, parent))
+		assert.NoError(t, cmds.Apply())
+		assert.Equal(t, []Entity{parent}, slices.Collect(ecs.Ancestors(child)))
+		assert.NoError(t, cmds.DestroyRecursive(parent))
+		assert.NoError(t, cmds.Apply())
+		assert.False(t, ecs.IsAlive(child))
+	})
+}
+
+func TestChangeDetection(t *testing.T) {
+	type transform struct {
+		x int
+	}
+	type velocity struct {
+		x int
+	}
+
+	t.Run("matches added components since the last iteration", func(t *testing.T) {
+		ecs := New()
+		first, err := ecs.Spawn(transform{})
+		assert.NoError(t, err)
+		q, err := NewQuery1[transform](&ecs, Added[transform](), ReadOnly[transform]())
+		assert.NoError(t, err)
+		collect := func() []Entity {
+			var entities []Entity
+			for row := range q.Iter() {
+				entities = append(entities, row.Entity)
+			}
+			return entities
+		}
+		assert.Equal(t, []Entity{first}, collect())
+		assert.Empty(t, collect())
+		second, err := ecs.Spawn(velocity{})
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.AddComponent(second, transform{}))
+		assert.Equal(t, []Entity{second}, collect())
+		assert.NoError(t, ecs.RemoveComponent(second, velocity{}))
+		assert.Empty(t, collect(), "moving between archetypes keeps the ticks")
+	})
+
+	t.Run("matches changed components since the last iteration", func(t *testing.T) {
+		ecs := New()
+		entities, err := ecs.SpawnBatch(4, transform{}, velocity{x: 1})
+		assert.NoError(t, err)
+		changed, err := NewQuery1[transform](&ecs, Changed[transform](), ReadOnly[transform]())
+		assert.NoError(t, err)
+		count := func() int {
+			n := 0
+			for range changed.Iter() {
+				n++
+			}
+			return n
+		}
+		assert.Equal(t, 4, count())
+		assert.Equal(t, 0, count())
+
+		readers, err := NewQuery2[transform, velocity](&ecs, ReadOnly[transform](), ReadOnly[velocity]())
+		assert.NoError(t, err)
+		for range readers.Iter() {
+		}
+		assert.Equal(t, 0, count())
+
+		writers, err := NewQuery2[transform, velocity](&ecs, ReadOnly[velocity]())
+		assert.NoError(t, err)
+		row, ok := writers.Get(entities[1])
+		assert.True(t, ok)
+		row.C1.x = 5
+		row.Mark()
+		iter, err := ecs.Query(transform{})
+		assert.NoError(t, err)
+		for res := range iter {
+			if res.Entity() == entities[3] {
+				assert.NoError(t, SetComponent(&res, transform{x: 3}))
+			}
+		}
+		var chunks [][]Entity
+		for chunk := range changed.Chunks() {
+			chunks = append(chunks, slices.Clone(chunk.Entities))
+		}
+		assert.Equal(t, [][]Entity{{entities[1]}, {entities[3]}}, chunks)
+
+		for row := range writers.Iter() {
+			row.C1.x++
+		}
+		assert.Equal(t, 0, count(), "writing through the pointers doesn't mark the rows")
+		for chunk := range writers.Chunks() {
+			chunk.Mark()
+		}
+		assert.Equal(t, 4, count())
+		for chunk := range readers.Chunks() {
+			chunk.Mark()
+		}
+		assert.Equal(t, 0, count(), "ReadOnly components are never marked")
+		assert.Equal(t, []reflect.Type{reflect.TypeFor[transform]()}, changed.Access().cmpReads)
+	})
+
+	t.Run("keeps the last iteration of queries prepared again", func(t *testing.T) {
+		ecs := New()
+		_, err := ecs.Spawn(transform{})
+		assert.NoError(t, err)
+		count := func() int {
+			changed, err := NewQuery1[transform](&ecs, Changed[transform](), ReadOnly[transform]())
+			assert.NoError(t, err)
+			n := 0
+			for range changed.Iter() {
+				n++
+			}
+			return n
+		}
+		assert.Equal(t, 1, count())
+		assert.Equal(t, 0, count())
+	})
+
+	t.Run("rejects change filters inside or", func(t *testing.T) {
+		ecs := New()
+		_, err := NewQuery1[transform](&ecs, Or(Changed[transform](), With[velocity]()))
+		assert.Error(t, err)
+	})
+
+	t.Run("reads removed components", func(t *testing.T) {
+		ecs := New()
+		removed, err := NewRemovedComponents[transform](&ecs)
+		assert.NoError(t, err)
+		entities, err := ecs.SpawnBatch(3, transform{}, velocity{})
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.RemoveComponent(entities[0], transform{}))
+		assert.NoError(t, ecs.RemoveComponent(entities[1], velocity{}))
+		assert.NoError(t, ecs.Destroy(entities[2]))
+		assert.Equal(t, []Entity{entities[0], entities[2]}, removed.Read())
+		assert.Empty(t, removed.Read())
+
+		assert.NoError(t, ecs.Destroy(entities[1]))
+		ecs.UpdateEvents()
+		late, err := NewRemovedComponents[transform](&ecs)
+		assert.NoError(t, err)
+		assert.Equal(t, []Entity{entities[0], entities[2], entities[1]}, late.Read())
+		ecs.UpdateEvents()
+		assert.Empty(t, removed.Read())
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	type Position struct {
+		X, Y float64
+	}
+	type Target struct {
+		Entity  Entity
+		Others  []Entity
+		ByName  map[string]Entity
+		private Entity
+	}
+	type player struct{}
+	type transient struct {
+		ticks int
+	}
+
+	types := NewTypeRegistry()
+	assert.NoError(t, RegisterType[Position](types, "Position"))
+	assert.NoError(t, RegisterType[Target](types, "Target"))
+	assert.NoError(t, RegisterType[player](types, "Player"))
+	assert.Error(t, RegisterType[Position](types, "Other"))
+	assert.Error(t, RegisterType[transient](types, "Player"))
+
+	spawnWorld := func(t *testing.T) (*ECS, []Entity) {
+		ecs := New()
+		entities, err := ecs.SpawnBatch(3, Position{X: 1, Y: 2}, transient{ticks: 5})
+		assert.NoError(t, err)
+		hero, err := ecs.Spawn(player{}, Position{X: 3}, Target{
+			Entity:  entities[0],
+			Others:  []Entity{entities[1], {}},
+			ByName:  map[string]Entity{"first": entities[2]},
+			private: entities[0],
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, ecs.SetParent(entities[2], hero))
+		assert.NoError(t, ecs.SetParent(entities[1], hero))
+		assert.NoError(t, ecs.Destroy(entities[0]))
+		return &ecs, []Entity{entities[1], entities[2], hero}
+	}
+	assertLoaded := func(t *testing.T, ecs *ECS, loaded []Entity) {
+		assert.Len(t, loaded, 3)
+		q, err := NewQuery2[Position, Target](ecs, With[player]())
+		assert.NoError(t, err)
+		var hero Entity
+		for row := range q.Iter() {
+			hero = row.Entity
+			assert.Equal(t, Position{X: 3}, *row.C1)
+			assert.Equal(t, Entity{}, row.C2.Entity, "references outside the snapshot are cleared")
+			assert.Equal(t, Entity{}, row.C2.private)
+			assert.Len(t, row.C2.Others, 2)
+			assert.Contains(t, loaded, row.C2.Others[0])
+			assert.Equal(t, Entity{}, row.C2.Others[1])
+			assert.Contains(t, loaded, row.C2.ByName["first"])
+			assert.Equal(t, slices.Collect(ecs.Descendants(hero)), []Entity{row.C2.ByName["first"], row.C2.Others[0]})
+		}
+		assert.True(t, ecs.IsAlive(hero))
+		transients, err := NewQuery1[transient](ecs)
+		assert.NoError(t, err)
+		for range transients.Iter() {
+			assert.Fail(t, "unregistered components are not saved")
+		}
+	}
+
+	t.Run("saves and loads binary", func(t *testing.T) {
+		ecs, _ := spawnWorld(t)
+		var buf bytes.Buffer
+		assert.NoError(t, ecs.SaveBinary(&buf, types))
+		world := New()
+		_, err := world.Spawn(Position{})
+		assert.NoError(t, err)
+		loaded, err := world.LoadBinary(&buf, types)
+		assert.NoError(t, err)
+		assertLoaded(t, &world, loaded)
+	})
+
+	t.Run("saves and loads json", func(t *testing.T) {
+		ecs, _ := spawnWorld(t)
+		var buf bytes.Buffer
+		assert.NoError(t, ecs.SaveJSON(&buf, types))
+		assert.Contains(t, buf.String(), `"Position": {`)
+		world := New()
+		loaded, err := world.LoadJSON(&buf, types)
+		assert.NoError(t, err)
+		assertLoaded(t, &world, loaded)
+	})
+
+	t.Run("saves filtered entities", func(t *testing.T) {
+		ecs, entities := spawnWorld(t)
+		var buf bytes.Buffer
+		assert.NoError(t, ecs.SaveJSON(&buf, types, Without[player]()))
+		world := New()
+		loaded, err := world.LoadJSON(&buf, types)
+		assert.NoError(t, err)
+		assert.Len(t, loaded, 2)
+		assert.NotContains(t, buf.String(), fmt.Sprint(entities[2].bits()))
+	})
+
+	t.Run("rejects unknown types and versions", func(t *testing.T) {
+		world := New()
+		_, err := world.LoadJSON(strings.NewReader(`{"version": 1, "entities": [{"id": 1, "components": {"Health": {}}}]}`), types)
+		assert.EqualError(t, err, `Unknown component type "Health"`)
+		_, err = world.LoadJSON(strings.NewReader(`{"version": 99, "entities": []}`), types)
+		assert.EqualError(t, err, "Unsupported snapshot version 99")
+	})
+
+	t.Run("rejects broken hierarchies without spawning", func(t *testing.T) {
+		world := New()
+		_, err := world.Spawn(Position{})
+		assert.NoError(t, err)
+		cases := map[string]string{
+			"Duplicate entity 1":                   `[{"id": 1}, {"id": 1}]`,
+			"Entity 3 has more than one parent":    `[{"id": 1, "children": [3]}, {"id": 2, "children": [3]}, {"id": 3}]`,
+			"Entity 1 can not be its own ancestor": `[{"id": 1, "children": [2], "components": {"Position": {}}}, {"id": 2, "children": [1]}]`,
+		}
+		for expected, entities := range cases {
+			_, err := world.LoadJSON(strings.NewReader(`{"version": 1, "entities": `+entities+`}`), types)
+			assert.EqualError(t, err, expected)
+		}
+		positions, err := NewQuery1[Position](&world)
+		assert.NoError(t, err)
+		count := 0
+		for range positions.Iter() {
+			count++
+		}
+		assert.Equal(t, 1, count)
+		spawned, err := world.SpawnBatch(2)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []uint32{1, 2}, []uint32{spawned[0].index, spawned[1].index}, "no handles are leaked")
 	})
 }
+
+type benchTransform struct {
+	x int
+	y int
+}
+
+// spawnBenchArchetypes fills the world with 1024 archetypes, 16 of which include benchTransform.
+func spawnBenchArchetypes(b *testing.B, ecs *ECS) {
+	markers := make([]any, 10)
+	for i := range markers {
+		markers[i] = reflect.New(reflect.ArrayOf(i, reflect.TypeFor[bool]())).Elem().Interface()
+	}
+	for mask := 0; mask < 1<<len(markers); mask++ {
+		var cmps []any
+		for i, marker := range markers {
+			if mask&(1<<i) != 0 {
+				cmps = append(cmps, marker)
+			}
+		}
+		if mask%64 == 0 {
+			cmps = append(cmps, benchTransform{x: 1})
+		}
+		_, err := ecs.Spawn(cmps...)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// scanQuery mirrors the uncached iterator, rebuilding the bitmap and scanning every archetype on each call.
+func scanQuery(ecs *ECS, cmps ...any) (func(yield func(QueryResult) bool), error) {
+	cmpIds := make([]uint32, len(cmps))
+	for i, cmp := range cmps {
+		cmpId, err := ecs.registry.id(reflect.TypeOf(cmp))
+		if err != nil {
+			return nil, err
+		}
+		cmpIds[i] = cmpId
+	}
+	queryBitmap := buildBitmap(cmpIds...)
+	return func(yield func(QueryResult) bool) {
+		for _, a := range ecs.archetypes {
+			if !bitmapIsSubset(queryBitmap, a.bitmap) {
+				continue
+			}
+			for idx := range a.ids {
+				qr := QueryResult{
+					registry:  ecs.registry,
+					archetype: a,
+					row:       idx,
+				}
+				if !yield(qr) {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+func BenchmarkQueryScan(b *testing.B) {
+	ecs := New()
+	spawnBenchArchetypes(b, &ecs)
+	b.ResetTimer()
+	for range b.N {
+		iter, err := scanQuery(&ecs, benchTransform{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for res := range iter {
+			_, _ = GetComponent[benchTransform](&res)
+		}
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	ecs := New()
+	spawnBenchArchetypes(b, &ecs)
+	b.ResetTimer()
+	for range b.N {
+		iter, err := ecs.Query(benchTransform{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for res := range iter {
+			_, _ = GetComponent[benchTransform](&res)
+		}
+	}
+}
+
+func BenchmarkQueryPrepared(b *testing.B) {
+	ecs := New()
+	spawnBenchArchetypes(b, &ecs)
+	q, err := NewQuery1[benchTransform](&ecs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for range b.N {
+		for row := range q.Iter() {
+			_ = row.C1.x
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package ecs
+
+import (
+	"reflect"
+	"sync"
+)
+
+type eventUpdater interface {
+	update()
+}
+
+// eventQueue double buffers the events of a single type. Events are sent into curr, which moves into prev on update
+// and is dropped on the update after that.
+type eventQueue[E any] struct {
+	prev []E
+	curr []E
+	// Ids of the first events in prev and curr. Every sent event gets the next id.
+	prevStart uint64
+	currStart uint64
+	mu        sync.RWMutex
+}
+
+func (q *eventQueue[E]) update() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	clear(q.prev)
+	q.prev, q.curr = q.curr, q.prev[:0]
+	q.prevStart = q.currStart
+	q.currStart = q.prevStart + uint64(len(q.prev))
+}
+
+func eventQueueOf[E any](ecs *ECS) *eventQueue[E] {
+	eventType := reflect.TypeFor[E]()
+	ecs.eventsMu.RLock()
+	queue, ok := ecs.events[eventType]
+	ecs.eventsMu.RUnlock()
+	if ok {
+		return queue.(*eventQueue[E])
+	}
+	ecs.eventsMu.Lock()
+	defer ecs.eventsMu.Unlock()
+	if queue, ok := ecs.events[eventType]; ok {
+		return queue.(*eventQueue[E])
+	}
+	q := &eventQueue[E]{}
+	ecs.events[eventType] = q
+	return q
+}
+
+// SendEvent sends the event to every EventReader of its type. Events stay readable until the second UpdateEvents
+// call after they were sent.
+func SendEvent[E any](ecs *ECS, event E) {
+	q := eventQueueOf[E](ecs)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.curr = append(q.curr, event)
+}
+
+// UpdateEvents swaps the event buffers of the world, dropping events that have already been visible for a full update.
+// hayal.Game calls it at the start of every tick.
+func (ecs *ECS) UpdateEvents() {
+	ecs.eventsMu.RLock()
+	defer ecs.eventsMu.RUnlock()
+	for _, queue := range ecs.events {
+		queue.update()
+	}
+}
+
+// EventReader reads events of type E. Every reader keeps its own cursor, so it yields each event once no matter how
+// many other readers there are. A reader is meant to be owned by a single system and is not safe for concurrent use.
+type EventReader[E any] struct {
+	queue  *eventQueue[E]
+	cursor uint64
+}
+
+// NewEventReader initializes a reader of events of type E. It starts with every event that is still buffered.
+func NewEventReader[E any](ecs *ECS) *EventReader[E] {
+	return &EventReader[E]{queue: eventQueueOf[E](ecs)}
+}
+
+// Read returns the events sent since the last call that haven't been dropped yet, oldest first.
+func (r *EventReader[E]) Read() []E {
+	q := r.queue
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	var events []E
+	if r.cursor < q.currStart {
+		start := max(r.cursor, q.prevStart) - q.prevStart
+		events = append(events, q.prev[start:]...)
+	}
+	start := max(r.cursor, q.currStart) - q.currStart
+	events = append(events, q.curr[start:]...)
+	r.cursor = q.currStart + uint64(len(q.curr))
+	return events
+}
+
+// removedKey keys the queue of removals of T in the events of the world.
+type removedKey[T any] struct{}
+
+// sendRemoved records that the entity lost the component, if anyone reads its removals. Must be called with mu held.
+func (ecs *ECS) sendRemoved(cmpId componentId, entity Entity) {
+	ecs.eventsMu.RLock()
+	q, ok := ecs.removed[cmpId]
+	ecs.eventsMu.RUnlock()
+	if !ok {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.curr = append(q.curr, entity)
+}
+
+// sendRemovedAll records that the entity lost every component of the archetype. Must be called with mu held.
+func (ecs *ECS) sendRemovedAll(entity Entity, a *archetype) {
+	for cmpId := range a.cmpIndices {
+		ecs.sendRemoved(cmpId, entity)
+	}
+}
+
+// RemovedComponents reads the entities that lost the component T, either because it was removed or because the entity
+// was destroyed. Like events, removals stay readable until the second UpdateEvents call after they happened. Only
+// removals after the first reader of T was created are recorded.
+type RemovedComponents[T any] struct {
+	reader EventReader[Entity]
+}
+
+// NewRemovedComponents initializes a reader of removals of the component T.
+func NewRemovedComponents[T any](ecs *ECS) (*RemovedComponents[T], error) {
+	cmpId, err := ecs.registry.id(reflect.TypeFor[T]())
+	if err != nil {
+		return nil, err
+	}
+	ecs.eventsMu.Lock()
+	defer ecs.eventsMu.Unlock()
+	q, ok := ecs.removed[cmpId]
+	if !ok {
+		q = &eventQueue[Entity]{}
+		ecs.removed[cmpId] = q
+		ecs.events[reflect.TypeFor[removedKey[T]]()] = q
+	}
+	return &RemovedComponents[T]{reader: EventReader[Entity]{queue: q}}, nil
+}
+
+// Read returns the entities that lost the component since the last call, oldest first. Entities that lost it more than
+// once are returned more than once.
+func (r *RemovedComponents[T]) Read() []Entity {
+	return r.reader.Read()
+}
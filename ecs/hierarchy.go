@@ -0,0 +1,255 @@
+package ecs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Parent points a child entity to its parent. It is maintained by the world, use SetParent and RemoveParent to change
+// it.
+type Parent struct {
+	entity Entity
+}
+
+// Entity returns the parent entity.
+func (p Parent) Entity() Entity {
+	return p.entity
+}
+
+// Children lists the children of a parent entity in the order they were added. It is maintained by the world, use
+// SetParent and RemoveParent to change it.
+type Children struct {
+	entities []Entity
+}
+
+// Entities returns a copy of the children.
+func (c Children) Entities() []Entity {
+	return slices.Clone(c.entities)
+}
+
+// SetParent makes child a child of parent, detaching it from its previous parent.
+func (ecs *ECS) SetParent(child Entity, parent Entity) error {
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	rec, ok := ecs.record(child)
+	if !ok {
+		return errors.New("Entity not found")
+	}
+	if _, ok := ecs.record(parent); !ok {
+		return errors.New("Entity not found")
+	}
+	for ancestor := parent; ; {
+		if ancestor == child {
+			return errors.New("Entity can not be its own ancestor")
+		}
+		p, ok := componentOf[Parent](ecs, ecs.entities[ancestor.index])
+		if !ok {
+			break
+		}
+		ancestor = p.entity
+	}
+	if p, ok := componentOf[Parent](ecs, *rec); ok {
+		if p.entity == parent {
+			return nil
+		}
+		old := p.entity
+		p.entity = parent
+		touchComponent[Parent](ecs, *rec)
+		ecs.detachChild(old, child)
+	} else {
+		ecs.insertComponent(child, Parent{entity: parent})
+	}
+	if c, ok := componentOf[Children](ecs, ecs.entities[parent.index]); ok {
+		c.entities = append(c.entities, child)
+		touchComponent[Children](ecs, ecs.entities[parent.index])
+	} else {
+		ecs.insertComponent(parent, Children{entities: []Entity{child}})
+	}
+	return nil
+}
+
+// RemoveParent detaches child from its parent, making it a root entity.
+func (ecs *ECS) RemoveParent(child Entity) error {
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	rec, ok := ecs.record(child)
+	if !ok {
+		return errors.New("Entity not found")
+	}
+	p, ok := componentOf[Parent](ecs, *rec)
+	if !ok {
+		return errors.New("Entity does not have a parent")
+	}
+	ecs.detachChild(p.entity, child)
+	ecs.deleteComponent(child, reflect.TypeFor[Parent]())
+	return nil
+}
+
+// DestroyRecursive destroys the entity and all of its descendants.
+func (ecs *ECS) DestroyRecursive(entity Entity) error {
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	if _, ok := ecs.record(entity); !ok {
+		return errors.New("Entity not found")
+	}
+	if p, ok := componentOf[Parent](ecs, ecs.entities[entity.index]); ok {
+		ecs.detachChild(p.entity, entity)
+	}
+	stack := []Entity{entity}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		rec := ecs.entities[e.index]
+		if c, ok := componentOf[Children](ecs, rec); ok {
+			stack = append(stack, c.entities...)
+		}
+		ecs.sendRemovedAll(e, ecs.archetypes[rec.archetype])
+		ecs.deleteRow(rec.archetype, rec.row)
+		ecs.freeEntity(e)
+	}
+	return nil
+}
+
+// Descendants returns an iterator of the descendants of the entity, depth first. The hierarchy is read lazily, so the
+// world can be changed while iterating.
+func (ecs *ECS) Descendants(entity Entity) func(yield func(Entity) bool) {
+	return func(yield func(Entity) bool) {
+		stack := ecs.children(entity)
+		slices.Reverse(stack)
+		for len(stack) > 0 {
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !yield(e) {
+				return
+			}
+			children := ecs.children(e)
+			slices.Reverse(children)
+			stack = append(stack, children...)
+		}
+	}
+}
+
+// Ancestors returns an iterator of the ancestors of the entity, starting with its parent. The hierarchy is read
+// lazily, so the world can be changed while iterating.
+func (ecs *ECS) Ancestors(entity Entity) func(yield func(Entity) bool) {
+	return func(yield func(Entity) bool) {
+		for {
+			parent, ok := ecs.parent(entity)
+			if !ok || !yield(parent) {
+				return
+			}
+			entity = parent
+		}
+	}
+}
+
+func (ecs *ECS) children(entity Entity) []Entity {
+	ecs.mu.RLock()
+	defer ecs.mu.RUnlock()
+	rec, ok := ecs.record(entity)
+	if !ok {
+		return nil
+	}
+	c, ok := componentOf[Children](ecs, *rec)
+	if !ok {
+		return nil
+	}
+	return c.Entities()
+}
+
+func (ecs *ECS) parent(entity Entity) (Entity, bool) {
+	ecs.mu.RLock()
+	defer ecs.mu.RUnlock()
+	rec, ok := ecs.record(entity)
+	if !ok {
+		return Entity{}, false
+	}
+	p, ok := componentOf[Parent](ecs, *rec)
+	if !ok {
+		return Entity{}, false
+	}
+	return p.entity, true
+}
+
+// unlink detaches the entity from its parent and its children, before it gets destroyed. Must be called with mu held.
+func (ecs *ECS) unlink(entity Entity) {
+	rec := ecs.entities[entity.index]
+	if p, ok := componentOf[Parent](ecs, rec); ok {
+		ecs.detachChild(p.entity, entity)
+	}
+	if c, ok := componentOf[Children](ecs, ecs.entities[entity.index]); ok {
+		for _, child := range c.entities {
+			ecs.deleteComponent(child, reflect.TypeFor[Parent]())
+		}
+	}
+}
+
+// detachChild removes child from the children of parent. Must be called with mu held.
+func (ecs *ECS) detachChild(parent Entity, child Entity) {
+	c, ok := componentOf[Children](ecs, ecs.entities[parent.index])
+	if !ok {
+		return
+	}
+	c.entities = slices.DeleteFunc(c.entities, func(e Entity) bool {
+		return e == child
+	})
+	if len(c.entities) == 0 {
+		ecs.deleteComponent(parent, reflect.TypeFor[Children]())
+	} else {
+		touchComponent[Children](ecs, ecs.entities[parent.index])
+	}
+}
+
+// componentOf returns a pointer to the component of the entity the record belongs to. It is only valid until the next
+// structural change. Must be called with mu held.
+func componentOf[C any](ecs *ECS, rec entityRecord) (*C, bool) {
+	cmpId, ok := ecs.registry.lookup(reflect.TypeFor[C]())
+	if !ok {
+		return nil, false
+	}
+	a := ecs.archetypes[rec.archetype]
+	idx, ok := a.cmpIndices[cmpId]
+	if !ok {
+		return nil, false
+	}
+	return &columnSlice[C](a.columns[idx])[rec.row], true
+}
+
+// touchComponent marks the component of the entity the record belongs to changed, after changing it in place. Must be
+// called with mu held.
+func touchComponent[C any](ecs *ECS, rec entityRecord) {
+	cmpId, _ := ecs.registry.lookup(reflect.TypeFor[C]())
+	a := ecs.archetypes[rec.archetype]
+	a.columns[a.cmpIndices[cmpId]].markChanged(rec.row, rec.row+1, ecs.nextTick())
+}
+
+// insertComponent adds a component to the live entity, unless it already has one of its type. Must be called with mu
+// held.
+func (ecs *ECS) insertComponent(entity Entity, cmp any) {
+	cmpId, _ := ecs.registry.id(reflect.TypeOf(cmp))
+	rec := &ecs.entities[entity.index]
+	ecs.moveEntity(entity, rec, setBitmap(ecs.archetypes[rec.archetype].bitmap, cmpId), cmpId, reflect.ValueOf(cmp))
+}
+
+// deleteComponent removes a component from the live entity, if it has one of the type. Must be called with mu held.
+func (ecs *ECS) deleteComponent(entity Entity, cmpType reflect.Type) {
+	cmpId, ok := ecs.registry.lookup(cmpType)
+	if !ok {
+		return
+	}
+	rec := &ecs.entities[entity.index]
+	if ecs.moveEntity(entity, rec, clearBitmap(ecs.archetypes[rec.archetype].bitmap, cmpId), cmpId, reflect.Value{}) {
+		ecs.sendRemoved(cmpId, entity)
+	}
+}
+
+// checkMaintained rejects adding or removing Parent and Children directly, which would break the links between
+// parents and children.
+func checkMaintained(cmpType reflect.Type) error {
+	if cmpType == reflect.TypeFor[Parent]() || cmpType == reflect.TypeFor[Children]() {
+		return fmt.Errorf("%v is maintained by the world, use SetParent and RemoveParent", cmpType)
+	}
+	return nil
+}
@@ -0,0 +1,742 @@
+package ecs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync/atomic"
+)
+
+type filterKind uint8
+
+const (
+	filterWith filterKind = iota
+	filterWithout
+	filterOptional
+	filterReadOnly
+	filterOr
+	filterAdded
+	filterChanged
+)
+
+// Filter narrows down the entities matched by a typed query. Use With, Without, Optional, Added, Changed and Or to build
+// one.
+type Filter struct {
+	kind     filterKind
+	cmpType  reflect.Type
+	children []Filter
+}
+
+// With matches entities that have the component, without fetching it.
+func With[T any]() Filter {
+	return Filter{kind: filterWith, cmpType: reflect.TypeFor[T]()}
+}
+
+// Without matches entities that don't have the component.
+func Without[T any]() Filter {
+	return Filter{kind: filterWithout, cmpType: reflect.TypeFor[T]()}
+}
+
+// Optional makes one of the components fetched by the query optional. Entities without it still match and get a nil
+// pointer in its place.
+func Optional[T any]() Filter {
+	return Filter{kind: filterOptional, cmpType: reflect.TypeFor[T]()}
+}
+
+// ReadOnly declares that one of the components fetched by the query is only read, which lets the system using the
+// query run in parallel with other readers of the component. It doesn't change which entities match.
+func ReadOnly[T any]() Filter {
+	return Filter{kind: filterReadOnly, cmpType: reflect.TypeFor[T]()}
+}
+
+// Added matches entities that got the component since the previous iteration of the query. Queries with the same
+// components and filters share the previous iteration, even if they were prepared separately. The first iteration
+// matches every entity that has it.
+func Added[T any]() Filter {
+	return Filter{kind: filterAdded, cmpType: reflect.TypeFor[T]()}
+}
+
+// Changed matches entities whose component was added or possibly changed since the previous iteration of the query,
+// which is shared like for Added. Components count as changed when they are set with SetComponent or GetMut, or
+// marked with Mark on the rows and chunks of a query that doesn't fetch them ReadOnly. The first iteration matches
+// every entity that has it.
+func Changed[T any]() Filter {
+	return Filter{kind: filterChanged, cmpType: reflect.TypeFor[T]()}
+}
+
+// Or matches entities that match any of the passed in filters.
+func Or(filters ...Filter) Filter {
+	return Filter{kind: filterOr, children: filters}
+}
+
+type queryMatcher struct {
+	required bitmap
+	excluded bitmap
+	// Each group needs at least one matching alternative.
+	ors [][]queryMatcher
+}
+
+func (m *queryMatcher) matches(b bitmap) bool {
+	if !bitmapIsSubset(m.required, b) || bitmapIntersects(m.excluded, b) {
+		return false
+	}
+	for _, alternatives := range m.ors {
+		matched := false
+		for i := range alternatives {
+			if alternatives[i].matches(b) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (ecs *ECS) compileFilters(matcher *queryMatcher, filters []Filter) error {
+	for _, filter := range filters {
+		switch filter.kind {
+		case filterWith, filterWithout, filterAdded, filterChanged:
+			cmpId, err := ecs.registry.id(filter.cmpType)
+			if err != nil {
+				return err
+			}
+			if filter.kind != filterWithout {
+				matcher.required = setBitmap(matcher.required, cmpId)
+			} else {
+				matcher.excluded = setBitmap(matcher.excluded, cmpId)
+			}
+		case filterOr:
+			alternatives := make([]queryMatcher, len(filter.children))
+			for i, child := range filter.children {
+				switch child.kind {
+				case filterOptional, filterReadOnly, filterAdded, filterChanged:
+					return errors.New("Optional, ReadOnly, Added and Changed can not be used inside Or")
+				}
+				err := ecs.compileFilters(&alternatives[i], []Filter{child})
+				if err != nil {
+					return err
+				}
+			}
+			matcher.ors = append(matcher.ors, alternatives)
+		}
+	}
+	return nil
+}
+
+type queryMatch struct {
+	archetype *archetype
+	// Column of every fetched component, or -1 for missing optional components
+	cols []int
+	// Column of every tick filter
+	tickCols []int
+}
+
+// tickFilter is an Added or Changed filter, which is checked per entity instead of per archetype.
+type tickFilter struct {
+	cmpId componentId
+	added bool
+}
+
+type queryState struct {
+	ecs     *ECS
+	matcher queryMatcher
+	cmpIds  []componentId
+	ticks   []tickFilter
+	// Archetypes matching the query, kept up to date by ensureArchetype. Guarded by ecs.mu.
+	matches []queryMatch
+	// Index into matches by archetype. Guarded by ecs.mu.
+	matchIndex map[*archetype]int
+	// Tick of the previous iteration, Added and Changed are relative to it. Kept on the cached state so queries
+	// prepared again on every frame don't start over.
+	lastRun atomic.Uint64
+}
+
+// prepareQuery returns the cached state of the query, creating and registering it with the world on first use.
+func (ecs *ECS) prepareQuery(cmpTypes []reflect.Type, filters []Filter) (*queryState, error) {
+	state := &queryState{ecs: ecs, cmpIds: make([]componentId, len(cmpTypes)), matchIndex: make(map[*archetype]int)}
+	var fetched bitmap
+	for i, cmpType := range cmpTypes {
+		cmpId, err := ecs.registry.id(cmpType)
+		if err != nil {
+			return nil, err
+		}
+		if bitmapHas(fetched, cmpId) {
+			return nil, errors.New("Duplicate component")
+		}
+		fetched = setBitmap(fetched, cmpId)
+		state.cmpIds[i] = cmpId
+	}
+	state.matcher.required = fetched
+	for _, filter := range filters {
+		if filter.kind != filterOptional && filter.kind != filterReadOnly {
+			continue
+		}
+		cmpId, err := ecs.registry.id(filter.cmpType)
+		if err != nil {
+			return nil, err
+		}
+		if !bitmapHas(fetched, cmpId) {
+			return nil, errors.New("Optional or ReadOnly component is not fetched by the query")
+		}
+		if filter.kind == filterOptional {
+			state.matcher.required = clearBitmap(state.matcher.required, cmpId)
+		}
+	}
+	err := ecs.compileFilters(&state.matcher, filters)
+	if err != nil {
+		return nil, err
+	}
+	for _, filter := range filters {
+		if filter.kind != filterAdded && filter.kind != filterChanged {
+			continue
+		}
+		cmpId, err := ecs.registry.id(filter.cmpType)
+		if err != nil {
+			return nil, err
+		}
+		state.ticks = append(state.ticks, tickFilter{cmpId: cmpId, added: filter.kind == filterAdded})
+	}
+	key := fmt.Sprint(state.cmpIds, state.matcher, state.ticks)
+	ecs.mu.RLock()
+	cached, ok := ecs.queries[key]
+	ecs.mu.RUnlock()
+	if ok {
+		return cached, nil
+	}
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	if cached, ok := ecs.queries[key]; ok {
+		return cached, nil
+	}
+	for _, a := range ecs.archetypes {
+		state.track(a)
+	}
+	ecs.queries[key] = state
+	return state, nil
+}
+
+// queryAccess builds the access of a query fetching the component types. Components are written unless marked
+// ReadOnly. Filtered components are never accessed, except for the change ticks read by Added and Changed.
+func queryAccess(cmpTypes []reflect.Type, filters []Filter) Access {
+	var access Access
+	for _, cmpType := range cmpTypes {
+		if isReadOnly(cmpType, filters) {
+			access.cmpReads = append(access.cmpReads, cmpType)
+		} else {
+			access.cmpWrites = append(access.cmpWrites, cmpType)
+		}
+	}
+	for _, filter := range filters {
+		if (filter.kind == filterAdded || filter.kind == filterChanged) && !slices.Contains(cmpTypes, filter.cmpType) {
+			access.cmpReads = append(access.cmpReads, filter.cmpType)
+		}
+	}
+	return access
+}
+
+func isReadOnly(cmpType reflect.Type, filters []Filter) bool {
+	return slices.ContainsFunc(filters, func(filter Filter) bool {
+		return filter.kind == filterReadOnly && filter.cmpType == cmpType
+	})
+}
+
+// track adds the archetype to the matches if the query matches it. Must be called with ecs.mu held.
+func (state *queryState) track(a *archetype) {
+	if !state.matcher.matches(a.bitmap) {
+		return
+	}
+	cols := make([]int, len(state.cmpIds))
+	for i, cmpId := range state.cmpIds {
+		col, ok := a.cmpIndices[cmpId]
+		if !ok {
+			col = -1
+		}
+		cols[i] = col
+	}
+	tickCols := make([]int, len(state.ticks))
+	for i, tick := range state.ticks {
+		tickCols[i] = a.cmpIndices[tick.cmpId]
+	}
+	state.matchIndex[a] = len(state.matches)
+	state.matches = append(state.matches, queryMatch{archetype: a, cols: cols, tickCols: tickCols})
+}
+
+// lookup returns the match and row of the entity, if it is alive and matches the query.
+func (state *queryState) lookup(entity Entity) (queryMatch, int, bool) {
+	state.ecs.mu.RLock()
+	defer state.ecs.mu.RUnlock()
+	rec, ok := state.ecs.record(entity)
+	if !ok {
+		return queryMatch{}, 0, false
+	}
+	idx, ok := state.matchIndex[state.ecs.archetypes[rec.archetype]]
+	if !ok {
+		return queryMatch{}, 0, false
+	}
+	return state.matches[idx], rec.row, true
+}
+
+// each calls fn for every run of contiguous matching rows. Without Added and Changed filters that is every matching
+// archetype, otherwise only rows changed after lastRun match.
+func (state *queryState) each(lastRun uint64, fn func(m queryMatch, start int, end int) bool) {
+	state.ecs.mu.RLock()
+	matches := state.matches
+	state.ecs.mu.RUnlock()
+	for _, m := range matches {
+		n := len(m.archetype.ids)
+		if len(state.ticks) == 0 {
+			if !fn(m, 0, n) {
+				return
+			}
+			continue
+		}
+		start := -1
+		for row := 0; row <= n; row++ {
+			ok := row < n && state.changedAfter(m, row, lastRun)
+			if ok && start < 0 {
+				start = row
+			}
+			if !ok && start >= 0 {
+				if !fn(m, start, row) {
+					return
+				}
+				start = -1
+			}
+		}
+	}
+}
+
+// changedAfter reports whether the row passes the Added and Changed filters of the query.
+func (state *queryState) changedAfter(m queryMatch, row int, lastRun uint64) bool {
+	for i, tick := range state.ticks {
+		col := m.archetype.columns[m.tickCols[i]]
+		ticks := col.changed
+		if tick.added {
+			ticks = col.added
+		}
+		if ticks[row] <= lastRun {
+			return false
+		}
+	}
+	return true
+}
+
+// query is shared by the typed queries of every arity.
+type query struct {
+	state  *queryState
+	access Access
+	// Indices of the fetched components that are not ReadOnly
+	writes []int
+}
+
+func newQuery(ecs *ECS, cmpTypes []reflect.Type, filters []Filter) (*query, error) {
+	state, err := ecs.prepareQuery(cmpTypes, filters)
+	if err != nil {
+		return nil, err
+	}
+	q := &query{state: state, access: queryAccess(cmpTypes, filters)}
+	for i, cmpType := range cmpTypes {
+		if !isReadOnly(cmpType, filters) {
+			q.writes = append(q.writes, i)
+		}
+	}
+	return q, nil
+}
+
+// Access returns the components the query reads and writes.
+func (q *query) Access() Access {
+	return q.access
+}
+
+// chunks calls fn for every run of matching rows.
+func (q *query) chunks(fn func(m queryMatch, start int, end int) bool) {
+	lastRun := q.state.lastRun.Swap(q.state.ecs.nextTick())
+	q.state.each(lastRun, fn)
+}
+
+// get returns the match and row of the entity if it matches the query.
+func (q *query) get(entity Entity) (queryMatch, int, bool) {
+	m, row, ok := q.state.lookup(entity)
+	if !ok || (len(q.state.ticks) > 0 && !q.state.changedAfter(m, row, q.state.lastRun.Load())) {
+		return queryMatch{}, 0, false
+	}
+	return m, row, true
+}
+
+// marker marks the rows from start to end of a match, it is embedded into the rows and chunks of every arity.
+type marker struct {
+	q     *query
+	m     queryMatch
+	start int
+	end   int
+}
+
+// Mark marks the components the query doesn't fetch ReadOnly as changed, so Changed filters match them. Writing through
+// the pointers alone isn't noticed, so only the rows that were actually changed pay for it.
+func (mk marker) Mark() {
+	if mk.q == nil {
+		return
+	}
+	tick := mk.q.state.ecs.nextTick()
+	for _, i := range mk.q.writes {
+		columnOf(mk.m.archetype, mk.m.cols[i]).markChanged(mk.start, mk.end, tick)
+	}
+}
+
+// row returns the marker of a single row of a chunk.
+func (mk marker) row(idx int) marker {
+	return marker{q: mk.q, m: mk.m, start: mk.start + idx, end: mk.start + idx + 1}
+}
+
+func columnOf(a *archetype, col int) *column {
+	if col < 0 {
+		return nil
+	}
+	return a.columns[col]
+}
+
+func ptrAt[C any](s []C, idx int) *C {
+	if s == nil {
+		return nil
+	}
+	return &s[idx]
+}
+
+// Row1 is a single entity yielded by Query1. The pointers point into the world's storage and are only valid until the
+// next structural change, such as spawning or destroying entities or adding or removing components.
+type Row1[A any] struct {
+	Entity Entity
+	C1     *A
+	marker
+}
+
+// Chunk1 is a contiguous run of entities of a single archetype yielded by Query1. Missing optional components are nil
+// slices. Like Row1, it is only valid until the next structural change.
+type Chunk1[A any] struct {
+	Entities []Entity
+	C1       []A
+	marker
+}
+
+// Query1 iterates entities that have the component A and match its filters. Queries are cached by the world and only
+// visit matching archetypes, so they are cheap to keep around between frames.
+type Query1[A any] struct {
+	*query
+}
+
+// NewQuery1 prepares a typed query for the component A.
+func NewQuery1[A any](ecs *ECS, filters ...Filter) (*Query1[A], error) {
+	cmpTypes := []reflect.Type{reflect.TypeFor[A]()}
+	q, err := newQuery(ecs, cmpTypes, filters)
+	if err != nil {
+		return nil, err
+	}
+	return &Query1[A]{query: q}, nil
+}
+
+// Chunks returns an iterator of the matching entities, one archetype at a time.
+func (q *Query1[A]) Chunks() func(yield func(Chunk1[A]) bool) {
+	return func(yield func(Chunk1[A]) bool) {
+		q.chunks(func(m queryMatch, start int, end int) bool {
+			return yield(Chunk1[A]{
+				Entities: m.archetype.ids[start:end],
+				C1:       columnRange[A](columnOf(m.archetype, m.cols[0]), start, end),
+				marker:   marker{q: q.query, m: m, start: start, end: end},
+			})
+		})
+	}
+}
+
+// Get returns the entity if it is alive and matches the query, with pointers like the ones yielded by Iter.
+func (q *Query1[A]) Get(entity Entity) (Row1[A], bool) {
+	m, row, ok := q.get(entity)
+	if !ok {
+		return Row1[A]{}, false
+	}
+	return Row1[A]{
+		Entity: entity,
+		C1:     ptrAt(columnSlice[A](columnOf(m.archetype, m.cols[0])), row),
+		marker: marker{q: q.query, m: m, start: row, end: row + 1},
+	}, true
+}
+
+// Iter returns an iterator of all matching entities, yielding pointers that mutate the components in place. Call Mark on
+// the rows that were changed for Changed filters to notice.
+func (q *Query1[A]) Iter() func(yield func(Row1[A]) bool) {
+	return func(yield func(Row1[A]) bool) {
+		for chunk := range q.Chunks() {
+			for idx, entity := range chunk.Entities {
+				r := Row1[A]{
+					Entity: entity,
+					C1:     ptrAt(chunk.C1, idx),
+					marker: chunk.row(idx),
+				}
+				if !yield(r) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Row2 is a single entity yielded by Query2. The pointers point into the world's storage and are only valid until the
+// next structural change, such as spawning or destroying entities or adding or removing components.
+type Row2[A, B any] struct {
+	Entity Entity
+	C1     *A
+	C2     *B
+	marker
+}
+
+// Chunk2 is a contiguous run of entities of a single archetype yielded by Query2. Missing optional components are nil
+// slices. Like Row2, it is only valid until the next structural change.
+type Chunk2[A, B any] struct {
+	Entities []Entity
+	C1       []A
+	C2       []B
+	marker
+}
+
+// Query2 iterates entities that have the components A and B and match its filters.
+type Query2[A, B any] struct {
+	*query
+}
+
+// NewQuery2 prepares a typed query for the components A and B.
+func NewQuery2[A, B any](ecs *ECS, filters ...Filter) (*Query2[A, B], error) {
+	cmpTypes := []reflect.Type{reflect.TypeFor[A](), reflect.TypeFor[B]()}
+	q, err := newQuery(ecs, cmpTypes, filters)
+	if err != nil {
+		return nil, err
+	}
+	return &Query2[A, B]{query: q}, nil
+}
+
+// Chunks returns an iterator of the matching entities, one archetype at a time.
+func (q *Query2[A, B]) Chunks() func(yield func(Chunk2[A, B]) bool) {
+	return func(yield func(Chunk2[A, B]) bool) {
+		q.chunks(func(m queryMatch, start int, end int) bool {
+			return yield(Chunk2[A, B]{
+				Entities: m.archetype.ids[start:end],
+				C1:       columnRange[A](columnOf(m.archetype, m.cols[0]), start, end),
+				C2:       columnRange[B](columnOf(m.archetype, m.cols[1]), start, end),
+				marker:   marker{q: q.query, m: m, start: start, end: end},
+			})
+		})
+	}
+}
+
+// Get returns the entity if it is alive and matches the query, with pointers like the ones yielded by Iter.
+func (q *Query2[A, B]) Get(entity Entity) (Row2[A, B], bool) {
+	m, row, ok := q.get(entity)
+	if !ok {
+		return Row2[A, B]{}, false
+	}
+	return Row2[A, B]{
+		Entity: entity,
+		C1:     ptrAt(columnSlice[A](columnOf(m.archetype, m.cols[0])), row),
+		C2:     ptrAt(columnSlice[B](columnOf(m.archetype, m.cols[1])), row),
+		marker: marker{q: q.query, m: m, start: row, end: row + 1},
+	}, true
+}
+
+// Iter returns an iterator of all matching entities, yielding pointers that mutate the components in place. Call Mark on
+// the rows that were changed for Changed filters to notice.
+func (q *Query2[A, B]) Iter() func(yield func(Row2[A, B]) bool) {
+	return func(yield func(Row2[A, B]) bool) {
+		for chunk := range q.Chunks() {
+			for idx, entity := range chunk.Entities {
+				r := Row2[A, B]{
+					Entity: entity,
+					C1:     ptrAt(chunk.C1, idx),
+					C2:     ptrAt(chunk.C2, idx),
+					marker: chunk.row(idx),
+				}
+				if !yield(r) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Row3 is a single entity yielded by Query3. The pointers point into the world's storage and are only valid until the
+// next structural change, such as spawning or destroying entities or adding or removing components.
+type Row3[A, B, C any] struct {
+	Entity Entity
+	C1     *A
+	C2     *B
+	C3     *C
+	marker
+}
+
+// Chunk3 is a contiguous run of entities of a single archetype yielded by Query3. Missing optional components are nil
+// slices. Like Row3, it is only valid until the next structural change.
+type Chunk3[A, B, C any] struct {
+	Entities []Entity
+	C1       []A
+	C2       []B
+	C3       []C
+	marker
+}
+
+// Query3 iterates entities that have the components A, B and C and match its filters.
+type Query3[A, B, C any] struct {
+	*query
+}
+
+// NewQuery3 prepares a typed query for the components A, B and C.
+func NewQuery3[A, B, C any](ecs *ECS, filters ...Filter) (*Query3[A, B, C], error) {
+	cmpTypes := []reflect.Type{reflect.TypeFor[A](), reflect.TypeFor[B](), reflect.TypeFor[C]()}
+	q, err := newQuery(ecs, cmpTypes, filters)
+	if err != nil {
+		return nil, err
+	}
+	return &Query3[A, B, C]{query: q}, nil
+}
+
+// Chunks returns an iterator of the matching entities, one archetype at a time.
+func (q *Query3[A, B, C]) Chunks() func(yield func(Chunk3[A, B, C]) bool) {
+	return func(yield func(Chunk3[A, B, C]) bool) {
+		q.chunks(func(m queryMatch, start int, end int) bool {
+			return yield(Chunk3[A, B, C]{
+				Entities: m.archetype.ids[start:end],
+				C1:       columnRange[A](columnOf(m.archetype, m.cols[0]), start, end),
+				C2:       columnRange[B](columnOf(m.archetype, m.cols[1]), start, end),
+				C3:       columnRange[C](columnOf(m.archetype, m.cols[2]), start, end),
+				marker:   marker{q: q.query, m: m, start: start, end: end},
+			})
+		})
+	}
+}
+
+// Get returns the entity if it is alive and matches the query, with pointers like the ones yielded by Iter.
+func (q *Query3[A, B, C]) Get(entity Entity) (Row3[A, B, C], bool) {
+	m, row, ok := q.get(entity)
+	if !ok {
+		return Row3[A, B, C]{}, false
+	}
+	return Row3[A, B, C]{
+		Entity: entity,
+		C1:     ptrAt(columnSlice[A](columnOf(m.archetype, m.cols[0])), row),
+		C2:     ptrAt(columnSlice[B](columnOf(m.archetype, m.cols[1])), row),
+		C3:     ptrAt(columnSlice[C](columnOf(m.archetype, m.cols[2])), row),
+		marker: marker{q: q.query, m: m, start: row, end: row + 1},
+	}, true
+}
+
+// Iter returns an iterator of all matching entities, yielding pointers that mutate the components in place. Call Mark on
+// the rows that were changed for Changed filters to notice.
+func (q *Query3[A, B, C]) Iter() func(yield func(Row3[A, B, C]) bool) {
+	return func(yield func(Row3[A, B, C]) bool) {
+		for chunk := range q.Chunks() {
+			for idx, entity := range chunk.Entities {
+				r := Row3[A, B, C]{
+					Entity: entity,
+					C1:     ptrAt(chunk.C1, idx),
+					C2:     ptrAt(chunk.C2, idx),
+					C3:     ptrAt(chunk.C3, idx),
+					marker: chunk.row(idx),
+				}
+				if !yield(r) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Row4 is a single entity yielded by Query4. The pointers point into the world's storage and are only valid until the
+// next structural change, such as spawning or destroying entities or adding or removing components.
+type Row4[A, B, C, D any] struct {
+	Entity Entity
+	C1     *A
+	C2     *B
+	C3     *C
+	C4     *D
+	marker
+}
+
+// Chunk4 is a contiguous run of entities of a single archetype yielded by Query4. Missing optional components are nil
+// slices. Like Row4, it is only valid until the next structural change.
+type Chunk4[A, B, C, D any] struct {
+	Entities []Entity
+	C1       []A
+	C2       []B
+	C3       []C
+	C4       []D
+	marker
+}
+
+// Query4 iterates entities that have the components A, B, C and D and match its filters.
+type Query4[A, B, C, D any] struct {
+	*query
+}
+
+// NewQuery4 prepares a typed query for the components A, B, C and D.
+func NewQuery4[A, B, C, D any](ecs *ECS, filters ...Filter) (*Query4[A, B, C, D], error) {
+	cmpTypes := []reflect.Type{reflect.TypeFor[A](), reflect.TypeFor[B](), reflect.TypeFor[C](), reflect.TypeFor[D]()}
+	q, err := newQuery(ecs, cmpTypes, filters)
+	if err != nil {
+		return nil, err
+	}
+	return &Query4[A, B, C, D]{query: q}, nil
+}
+
+// Chunks returns an iterator of the matching entities, one archetype at a time.
+func (q *Query4[A, B, C, D]) Chunks() func(yield func(Chunk4[A, B, C, D]) bool) {
+	return func(yield func(Chunk4[A, B, C, D]) bool) {
+		q.chunks(func(m queryMatch, start int, end int) bool {
+			return yield(Chunk4[A, B, C, D]{
+				Entities: m.archetype.ids[start:end],
+				C1:       columnRange[A](columnOf(m.archetype, m.cols[0]), start, end),
+				C2:       columnRange[B](columnOf(m.archetype, m.cols[1]), start, end),
+				C3:       columnRange[C](columnOf(m.archetype, m.cols[2]), start, end),
+				C4:       columnRange[D](columnOf(m.archetype, m.cols[3]), start, end),
+				marker:   marker{q: q.query, m: m, start: start, end: end},
+			})
+		})
+	}
+}
+
+// Get returns the entity if it is alive and matches the query, with pointers like the ones yielded by Iter.
+func (q *Query4[A, B, C, D]) Get(entity Entity) (Row4[A, B, C, D], bool) {
+	m, row, ok := q.get(entity)
+	if !ok {
+		return Row4[A, B, C, D]{}, false
+	}
+	return Row4[A, B, C, D]{
+		Entity: entity,
+		C1:     ptrAt(columnSlice[A](columnOf(m.archetype, m.cols[0])), row),
+		C2:     ptrAt(columnSlice[B](columnOf(m.archetype, m.cols[1])), row),
+		C3:     ptrAt(columnSlice[C](columnOf(m.archetype, m.cols[2])), row),
+		C4:     ptrAt(columnSlice[D](columnOf(m.archetype, m.cols[3])), row),
+		marker: marker{q: q.query, m: m, start: row, end: row + 1},
+	}, true
+}
+
+// Iter returns an iterator of all matching entities, yielding pointers that mutate the components in place. Call Mark on
+// the rows that were changed for Changed filters to notice.
+func (q *Query4[A, B, C, D]) Iter() func(yield func(Row4[A, B, C, D]) bool) {
+	return func(yield func(Row4[A, B, C, D]) bool) {
+		for chunk := range q.Chunks() {
+			for idx, entity := range chunk.Entities {
+				r := Row4[A, B, C, D]{
+					Entity: entity,
+					C1:     ptrAt(chunk.C1, idx),
+					C2:     ptrAt(chunk.C2, idx),
+					C3:     ptrAt(chunk.C3, idx),
+					C4:     ptrAt(chunk.C4, idx),
+					marker: chunk.row(idx),
+				}
+				if !yield(r) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package ecs
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+type componentId = uint32
+
+// Registry assigns ids to component types. Every world creates its own registry unless one is shared explicitly
+// through WithRegistry, in which case component ids match across the worlds sharing it.
+type Registry struct {
+	mu    sync.RWMutex
+	ids   map[reflect.Type]componentId
+	types []reflect.Type
+}
+
+// NewRegistry initializes an empty component registry.
+func NewRegistry() *Registry {
+	return &Registry{ids: make(map[reflect.Type]componentId)}
+}
+
+func (r *Registry) id(cmpType reflect.Type) (componentId, error) {
+	if cmpType == nil {
+		return 0, errors.New("Component can not be nil")
+	}
+	r.mu.RLock()
+	id, ok := r.ids[cmpType]
+	r.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.ids[cmpType]; ok {
+		return id, nil
+	}
+	id = componentId(len(r.types))
+	r.ids[cmpType] = id
+	r.types = append(r.types, cmpType)
+	return id, nil
+}
+
+// lookup returns the id of an already registered component type.
+func (r *Registry) lookup(cmpType reflect.Type) (componentId, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.ids[cmpType]
+	return id, ok
+}
+
+func (r *Registry) typeOf(id componentId) reflect.Type {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.types[id]
+}
+
+// EntityAllocator hands out entity indices and generations. Every world creates its own allocator unless one is
+// shared explicitly through WithEntityAllocator, in which case entities spawned in either world never collide.
+type EntityAllocator struct {
+	mu          sync.Mutex
+	generations []uint32
+	free        []uint32
+}
+
+// NewEntityAllocator initializes an empty entity allocator.
+func NewEntityAllocator() *EntityAllocator {
+	return &EntityAllocator{}
+}
+
+func (a *EntityAllocator) alloc() Entity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n := len(a.free); n > 0 {
+		index := a.free[n-1]
+		a.free = a.free[:n-1]
+		return Entity{index: index, generation: a.generations[index]}
+	}
+	a.generations = append(a.generations, 1)
+	return Entity{index: uint32(len(a.generations) - 1), generation: 1}
+}
+
+func (a *EntityAllocator) release(entity Entity) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.generations[entity.index]++
+	if a.generations[entity.index] == 0 {
+		a.generations[entity.index] = 1
+	}
+	a.free = append(a.free, entity.index)
+}
+
+type options struct {
+	registry  *Registry
+	allocator *EntityAllocator
+}
+
+// Option configures a world created with New.
+type Option func(opts *options)
+
+// WithRegistry makes the world use the passed in component registry instead of creating its own.
+func WithRegistry(registry *Registry) Option {
+	return func(opts *options) {
+		opts.registry = registry
+	}
+}
+
+// WithEntityAllocator makes the world use the passed in entity allocator instead of creating its own.
+func WithEntityAllocator(allocator *EntityAllocator) Option {
+	return func(opts *options) {
+		opts.allocator = allocator
+	}
+}
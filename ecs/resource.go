@@ -0,0 +1,79 @@
+package ecs
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// resource holds a single world-wide value. Its lock lets systems running in parallel read it together while writes
+// are exclusive.
+type resource struct {
+	value any
+	mu    sync.RWMutex
+}
+
+func (ecs *ECS) resource(resType reflect.Type) (*resource, bool) {
+	ecs.resourcesMu.RLock()
+	defer ecs.resourcesMu.RUnlock()
+	res, ok := ecs.resources[resType]
+	return res, ok
+}
+
+// InsertResource stores a world-wide singleton such as time, score or configuration, replacing any resource of the
+// same type.
+func InsertResource[T any](ecs *ECS, value T) {
+	resType := reflect.TypeFor[T]()
+	if res, ok := ecs.resource(resType); ok {
+		res.mu.Lock()
+		defer res.mu.Unlock()
+		*res.value.(*T) = value
+		return
+	}
+	ecs.resourcesMu.Lock()
+	defer ecs.resourcesMu.Unlock()
+	if res, ok := ecs.resources[resType]; ok {
+		res.mu.Lock()
+		defer res.mu.Unlock()
+		*res.value.(*T) = value
+		return
+	}
+	ecs.resources[resType] = &resource{value: &value}
+}
+
+// Resource returns a copy of the resource of type T.
+func Resource[T any](ecs *ECS) (T, error) {
+	res, ok := ecs.resource(reflect.TypeFor[T]())
+	if !ok {
+		var zero T
+		return zero, errors.New("Resource not found")
+	}
+	res.mu.RLock()
+	defer res.mu.RUnlock()
+	return *res.value.(*T), nil
+}
+
+// ResourceMut calls fn with a pointer to the resource of type T, holding exclusive access to it until fn returns. The
+// pointer must not be retained after fn returns.
+func ResourceMut[T any](ecs *ECS, fn func(res *T)) error {
+	res, ok := ecs.resource(reflect.TypeFor[T]())
+	if !ok {
+		return errors.New("Resource not found")
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	fn(res.value.(*T))
+	return nil
+}
+
+// RemoveResource removes the resource of type T from the world.
+func RemoveResource[T any](ecs *ECS) error {
+	ecs.resourcesMu.Lock()
+	defer ecs.resourcesMu.Unlock()
+	resType := reflect.TypeFor[T]()
+	if _, ok := ecs.resources[resType]; !ok {
+		return errors.New("Resource not found")
+	}
+	delete(ecs.resources, resType)
+	return nil
+}
@@ -0,0 +1,519 @@
+package ecs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// snapshotVersion is bumped whenever the layout of saved worlds changes.
+const snapshotVersion = 1
+
+var (
+	entityType   = reflect.TypeFor[Entity]()
+	parentType   = reflect.TypeFor[Parent]()
+	childrenType = reflect.TypeFor[Children]()
+)
+
+// TypeRegistry maps stable names to component types, so saved worlds and other data files keep working when Go types
+// are renamed or moved between packages. It is safe for concurrent use.
+type TypeRegistry struct {
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+// NewTypeRegistry initializes an empty type registry.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{types: make(map[string]reflect.Type), names: make(map[reflect.Type]string)}
+}
+
+// RegisterType registers the component type T under name.
+func RegisterType[T any](types *TypeRegistry, name string) error {
+	t := reflect.TypeFor[T]()
+	types.mu.Lock()
+	defer types.mu.Unlock()
+	if _, ok := types.types[name]; ok {
+		return fmt.Errorf("Duplicate type name %q", name)
+	}
+	if _, ok := types.names[t]; ok {
+		return fmt.Errorf("Type %v is already registered", t)
+	}
+	types.types[name] = t
+	types.names[t] = name
+	return nil
+}
+
+// Lookup returns the type registered under name.
+func (r *TypeRegistry) Lookup(name string) (reflect.Type, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[name]
+	return t, ok
+}
+
+// Name returns the name the type is registered under.
+func (r *TypeRegistry) Name(t reflect.Type) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, ok := r.names[t]
+	return name, ok
+}
+
+func (e Entity) bits() uint64 {
+	return uint64(e.index)<<32 | uint64(e.generation)
+}
+
+func entityFromBits(bits uint64) Entity {
+	return Entity{index: uint32(bits >> 32), generation: uint32(bits)}
+}
+
+// MarshalJSON encodes the entity as a number, so components referencing entities can be saved.
+func (e Entity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.bits())
+}
+
+func (e *Entity) UnmarshalJSON(data []byte) error {
+	var bits uint64
+	if err := json.Unmarshal(data, &bits); err != nil {
+		return err
+	}
+	*e = entityFromBits(bits)
+	return nil
+}
+
+// GobEncode encodes the entity, so components referencing entities can be saved.
+func (e Entity) GobEncode() ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, e.bits()), nil
+}
+
+func (e *Entity) GobDecode(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("Invalid entity encoding")
+	}
+	*e = entityFromBits(binary.BigEndian.Uint64(data))
+	return nil
+}
+
+// snapshotGroup holds the saved entities of a single archetype.
+type snapshotGroup struct {
+	names    []string
+	entities []Entity
+	// Saved children of every entity, in order
+	children [][]Entity
+	// Copy of the column of every named component
+	columns []reflect.Value
+}
+
+// snapshot copies the entities matching the filters. Only components registered in types are saved, along with the
+// hierarchy between the saved entities.
+func (ecs *ECS) snapshot(types *TypeRegistry, filters []Filter) ([]snapshotGroup, error) {
+	var matcher queryMatcher
+	if err := ecs.compileFilters(&matcher, filters); err != nil {
+		return nil, err
+	}
+	ecs.mu.RLock()
+	defer ecs.mu.RUnlock()
+	var groups []snapshotGroup
+	saved := make(map[Entity]bool)
+	for _, a := range ecs.archetypes {
+		if len(a.ids) == 0 || !matcher.matches(a.bitmap) {
+			continue
+		}
+		g := snapshotGroup{entities: slices.Clone(a.ids), children: make([][]Entity, len(a.ids))}
+		for _, col := range a.columns {
+			if col.cmpType == childrenType {
+				for row, c := range columnSlice[Children](col) {
+					g.children[row] = slices.Clone(c.entities)
+				}
+				continue
+			}
+			name, ok := types.Name(col.cmpType)
+			if !ok || col.cmpType == parentType {
+				continue
+			}
+			data := reflect.MakeSlice(col.data.Type(), col.data.Len(), col.data.Len())
+			reflect.Copy(data, col.data)
+			g.names = append(g.names, name)
+			g.columns = append(g.columns, data)
+		}
+		for _, entity := range a.ids {
+			saved[entity] = true
+		}
+		groups = append(groups, g)
+	}
+	for _, g := range groups {
+		for row, children := range g.children {
+			g.children[row] = slices.DeleteFunc(children, func(child Entity) bool {
+				return !saved[child]
+			})
+		}
+	}
+	return groups, nil
+}
+
+// loadedEntity is a saved entity, decoded but not spawned yet.
+type loadedEntity struct {
+	id       Entity
+	children []Entity
+	cmps     []any
+}
+
+// load spawns the loaded entities, remapping the entities referenced by their components and their hierarchy to the
+// spawned ones. References to entities that are not part of the snapshot become the zero entity.
+func (ecs *ECS) load(loaded []loadedEntity) ([]Entity, error) {
+	if err := checkHierarchy(loaded); err != nil {
+		return nil, err
+	}
+	bitmaps := make([]bitmap, len(loaded))
+	for i, e := range loaded {
+		b, err := ecs.buildCmpsBitmap(e.cmps)
+		if err != nil {
+			return nil, err
+		}
+		bitmaps[i] = b
+	}
+	spawned := make([]Entity, len(loaded))
+	mapping := make(map[Entity]Entity, len(loaded))
+	for i, e := range loaded {
+		spawned[i] = ecs.allocator.alloc()
+		mapping[e.id] = spawned[i]
+	}
+	for i, e := range loaded {
+		for j, cmp := range e.cmps {
+			e.cmps[j] = remapEntities(cmp, mapping)
+		}
+		err := ecs.spawnReserved(spawned[i:i+1], bitmaps[i], e.cmps)
+		if err != nil {
+			// The failed entity is already released.
+			ecs.unload(spawned[:i], spawned[i+1:])
+			return nil, err
+		}
+	}
+	for i, e := range loaded {
+		for _, child := range e.children {
+			if c, ok := mapping[child]; ok {
+				if err := ecs.SetParent(c, spawned[i]); err != nil {
+					ecs.unload(spawned, nil)
+					return nil, err
+				}
+			}
+		}
+	}
+	return spawned, nil
+}
+
+// unload undoes a failed load, destroying the entities already spawned and releasing the ones only allocated.
+func (ecs *ECS) unload(spawned []Entity, allocated []Entity) {
+	for _, entity := range spawned {
+		_ = ecs.Destroy(entity)
+	}
+	for _, entity := range allocated {
+		ecs.allocator.release(entity)
+	}
+}
+
+// checkHierarchy rejects duplicate entities and children lists that don't form a tree, before anything is spawned.
+// Children that aren't part of the snapshot are ignored, like when loading.
+func checkHierarchy(loaded []loadedEntity) error {
+	ids := make(map[Entity]bool, len(loaded))
+	for _, e := range loaded {
+		if ids[e.id] {
+			return fmt.Errorf("Duplicate entity %d", e.id.bits())
+		}
+		ids[e.id] = true
+	}
+	parents := make(map[Entity]Entity)
+	for _, e := range loaded {
+		for _, child := range e.children {
+			if !ids[child] {
+				continue
+			}
+			if _, ok := parents[child]; ok {
+				return fmt.Errorf("Entity %d has more than one parent", child.bits())
+			}
+			parents[child] = e.id
+		}
+	}
+	// Entities whose ancestors end in a root
+	rooted := make(map[Entity]bool, len(loaded))
+	for _, e := range loaded {
+		var path []Entity
+		for entity := e.id; !rooted[entity]; {
+			// Every entity has at most one parent, so a walk longer than the snapshot means a cycle.
+			if len(path) == len(loaded) {
+				return fmt.Errorf("Entity %d can not be its own ancestor", e.id.bits())
+			}
+			path = append(path, entity)
+			parent, ok := parents[entity]
+			if !ok {
+				break
+			}
+			entity = parent
+		}
+		for _, entity := range path {
+			rooted[entity] = true
+		}
+	}
+	return nil
+}
+
+func remapEntities(cmp any, mapping map[Entity]Entity) any {
+	t := reflect.TypeOf(cmp)
+	if !containsEntity(t, map[reflect.Type]bool{}) {
+		return cmp
+	}
+	v := reflect.New(t).Elem()
+	v.Set(reflect.ValueOf(cmp))
+	remapValue(v, mapping)
+	return v.Interface()
+}
+
+func containsEntity(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == entityType {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if containsEntity(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	case reflect.Array, reflect.Slice, reflect.Pointer:
+		return containsEntity(t.Elem(), seen)
+	case reflect.Map:
+		return containsEntity(t.Key(), seen) || containsEntity(t.Elem(), seen)
+	}
+	return false
+}
+
+// remapValue replaces the entities in the addressable value, including the ones in unexported fields.
+func remapValue(v reflect.Value, mapping map[Entity]Entity) {
+	if v.Type() == entityType {
+		old := *(*Entity)(unsafe.Pointer(v.UnsafeAddr()))
+		*(*Entity)(unsafe.Pointer(v.UnsafeAddr())) = mapping[old]
+		return
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			remapValue(v.Field(i), mapping)
+		}
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			remapValue(v.Index(i), mapping)
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			remapValue(v.Elem(), mapping)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		t := v.Type()
+		remapped := reflect.MakeMapWithSize(t, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := reflect.New(t.Key()).Elem()
+			key.Set(iter.Key())
+			remapValue(key, mapping)
+			val := reflect.New(t.Elem()).Elem()
+			val.Set(iter.Value())
+			remapValue(val, mapping)
+			remapped.SetMapIndex(key, val)
+		}
+		reflect.NewAt(t, unsafe.Pointer(v.UnsafeAddr())).Elem().Set(remapped)
+	}
+}
+
+type binarySnapshot struct {
+	Version int
+	Groups  []binaryGroup
+}
+
+type binaryGroup struct {
+	Names    []string
+	Entities []uint64
+	Children [][]uint64
+	// Gob encoding of the column of every named component
+	Columns [][]byte
+}
+
+// SaveBinary writes the entities matching the filters to w in a compact binary format. Only the components registered
+// in types are saved, and they have to be encodable with encoding/gob. Filters are matched like With, Without and Or
+// filters of typed queries.
+func (ecs *ECS) SaveBinary(w io.Writer, types *TypeRegistry, filters ...Filter) error {
+	groups, err := ecs.snapshot(types, filters)
+	if err != nil {
+		return err
+	}
+	snap := binarySnapshot{Version: snapshotVersion, Groups: make([]binaryGroup, len(groups))}
+	for i, g := range groups {
+		bg := binaryGroup{Names: g.names, Children: make([][]uint64, len(g.children))}
+		for _, entity := range g.entities {
+			bg.Entities = append(bg.Entities, entity.bits())
+		}
+		for row, children := range g.children {
+			for _, child := range children {
+				bg.Children[row] = append(bg.Children[row], child.bits())
+			}
+		}
+		for _, col := range g.columns {
+			data, err := encodeColumn(col)
+			if err != nil {
+				return err
+			}
+			bg.Columns = append(bg.Columns, data)
+		}
+		snap.Groups[i] = bg
+	}
+	return gob.NewEncoder(w).Encode(snap)
+}
+
+// LoadBinary spawns the entities saved with SaveBinary into the world and returns them. Entities referenced by the
+// loaded components are remapped to the spawned entities.
+func (ecs *ECS) LoadBinary(r io.Reader, types *TypeRegistry) ([]Entity, error) {
+	var snap binarySnapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %d", snap.Version)
+	}
+	var loaded []loadedEntity
+	for _, g := range snap.Groups {
+		if len(g.Names) != len(g.Columns) || len(g.Children) != len(g.Entities) {
+			return nil, errors.New("Corrupt snapshot")
+		}
+		columns := make([]reflect.Value, len(g.Names))
+		for i, name := range g.Names {
+			t, ok := types.Lookup(name)
+			if !ok {
+				return nil, fmt.Errorf("Unknown component type %q", name)
+			}
+			col, err := decodeColumn(g.Columns[i], t, len(g.Entities))
+			if err != nil {
+				return nil, err
+			}
+			columns[i] = col
+		}
+		for row, bits := range g.Entities {
+			e := loadedEntity{id: entityFromBits(bits), cmps: make([]any, len(columns))}
+			for _, child := range g.Children[row] {
+				e.children = append(e.children, entityFromBits(child))
+			}
+			for i, col := range columns {
+				e.cmps[i] = col.Index(row).Interface()
+			}
+			loaded = append(loaded, e)
+		}
+	}
+	return ecs.load(loaded)
+}
+
+// encodeColumn encodes the slice with gob. Zero sized components such as tags carry no data and are not encoded, gob
+// rejects them.
+func encodeColumn(col reflect.Value) ([]byte, error) {
+	if col.Type().Elem().Size() == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).EncodeValue(col); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeColumn(data []byte, t reflect.Type, n int) (reflect.Value, error) {
+	if t.Size() == 0 {
+		return reflect.MakeSlice(reflect.SliceOf(t), n, n), nil
+	}
+	col := reflect.New(reflect.SliceOf(t))
+	if err := gob.NewDecoder(bytes.NewReader(data)).DecodeValue(col); err != nil {
+		return reflect.Value{}, err
+	}
+	if col.Elem().Len() != n {
+		return reflect.Value{}, errors.New("Corrupt snapshot")
+	}
+	return col.Elem(), nil
+}
+
+type jsonSnapshot struct {
+	Version  int          `json:"version"`
+	Entities []jsonEntity `json:"entities"`
+}
+
+type jsonEntity struct {
+	Id         Entity                     `json:"id"`
+	Children   []Entity                   `json:"children,omitempty"`
+	Components map[string]json.RawMessage `json:"components"`
+}
+
+// SaveJSON writes the entities matching the filters to w as indented JSON, for debugging and hand editing. Only the
+// components registered in types are saved, and they have to be encodable with encoding/json. Filters are matched like
+// With, Without and Or filters of typed queries.
+func (ecs *ECS) SaveJSON(w io.Writer, types *TypeRegistry, filters ...Filter) error {
+	groups, err := ecs.snapshot(types, filters)
+	if err != nil {
+		return err
+	}
+	snap := jsonSnapshot{Version: snapshotVersion, Entities: []jsonEntity{}}
+	for _, g := range groups {
+		for row, entity := range g.entities {
+			e := jsonEntity{Id: entity, Children: g.children[row], Components: make(map[string]json.RawMessage)}
+			for i, name := range g.names {
+				data, err := json.Marshal(g.columns[i].Index(row).Interface())
+				if err != nil {
+					return err
+				}
+				e.Components[name] = data
+			}
+			snap.Entities = append(snap.Entities, e)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// LoadJSON spawns the entities saved with SaveJSON into the world and returns them. Entities referenced by the loaded
+// components are remapped to the spawned entities.
+func (ecs *ECS) LoadJSON(r io.Reader, types *TypeRegistry) ([]Entity, error) {
+	var snap jsonSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %d", snap.Version)
+	}
+	loaded := make([]loadedEntity, len(snap.Entities))
+	for i, e := range snap.Entities {
+		loaded[i] = loadedEntity{id: e.Id, children: e.Children}
+		for name, data := range e.Components {
+			t, ok := types.Lookup(name)
+			if !ok {
+				return nil, fmt.Errorf("Unknown component type %q", name)
+			}
+			v := reflect.New(t)
+			if err := json.Unmarshal(data, v.Interface()); err != nil {
+				return nil, fmt.Errorf("Invalid component %q: %w", name, err)
+			}
+			loaded[i].cmps = append(loaded[i].cmps, v.Elem().Interface())
+		}
+	}
+	return ecs.load(loaded)
+}
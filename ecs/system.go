@@ -1,14 +1,35 @@
 package ecs
 
+// SystemCtx is the view of the world passed into systems. Depending on the implementation, structural changes made
+// through it (spawning, destroying, adding or removing components and changing parents) may be deferred to a Commands
+// buffer instead of being applied right away.
 type SystemCtx interface {
-	// Spawn initializes a new entity with the passed in component.
-	Spawn(cmp any) (entity, error)
+	// Spawn initializes a new entity with the passed in components. Structs embedding Bundle are expanded into their
+	// fields.
+	Spawn(cmps ...any) (Entity, error)
+	// SpawnBatch initializes n new entities that share the passed in components.
+	SpawnBatch(n int, cmps ...any) ([]Entity, error)
+	// SpawnTemplate initializes n new entities from the template, with the overrides replacing its components of the
+	// same type or adding new ones.
+	SpawnTemplate(t *Template, n int, overrides ...any) ([]Entity, error)
 	// Destroy de-initializes the passed in entity.
-	Destroy(entity entity) error
+	Destroy(entity Entity) error
+	// IsAlive reports whether the entity handle still points to a spawned entity.
+	IsAlive(entity Entity) bool
 	// AddComponent adds the passed in component to the entity.
-	AddComponent(entity entity, cmp any) error
+	AddComponent(entity Entity, cmp any) error
 	// RemoveComponent removes the passed in component from the entity.
-	RemoveComponent(entity entity, cmp any) error
+	RemoveComponent(entity Entity, cmp any) error
+	// SetParent makes child a child of parent, detaching it from its previous parent.
+	SetParent(child Entity, parent Entity) error
+	// RemoveParent detaches child from its parent.
+	RemoveParent(child Entity) error
+	// DestroyRecursive de-initializes the passed in entity and all of its descendants.
+	DestroyRecursive(entity Entity) error
 	// Query returns an iterator of all entities that includes the passed in components.
 	Query(cmps ...any) (func(yield func(QueryResult) bool), error)
+	// Commands returns the command buffer structural changes of the system are recorded into.
+	Commands() *Commands
+	// World returns the underlying world, to be passed into typed queries such as NewQuery2.
+	World() *ECS
 }
@@ -0,0 +1,93 @@
+package ecs
+
+import (
+	"errors"
+	"reflect"
+)
+
+// Template is a set of components compiled once for a world, so many entities can be spawned from it with a single
+// batch insert. Components are copied into every spawned entity shallowly, slices and maps inside them are shared.
+type Template struct {
+	ecs  *ECS
+	cmps []any
+	// Archetype of the components and their values ordered by its columns
+	archetype int
+	row       []reflect.Value
+}
+
+// NewTemplate compiles the components into a template for the world. Structs embedding Bundle are expanded into their
+// fields.
+func NewTemplate(ecs *ECS, cmps ...any) (*Template, error) {
+	cmps = expandBundles(cmps)
+	bitmap, err := ecs.buildCmpsBitmap(cmps)
+	if err != nil {
+		return nil, err
+	}
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	aIdx := ecs.ensureArchetype(bitmap)
+	row, err := ecs.buildRow(ecs.archetypes[aIdx], cmps)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{ecs: ecs, cmps: cmps, archetype: aIdx, row: row}, nil
+}
+
+// withOverrides returns the components of the template with the overrides replacing the components of the same type
+// and the rest of them added.
+func (t *Template) withOverrides(overrides []any) []any {
+	cmps := append([]any(nil), t.cmps...)
+	for _, override := range expandBundles(overrides) {
+		replaced := false
+		for i, cmp := range cmps {
+			if reflect.TypeOf(cmp) == reflect.TypeOf(override) {
+				cmps[i] = override
+				replaced = true
+			}
+		}
+		if !replaced {
+			cmps = append(cmps, override)
+		}
+	}
+	return cmps
+}
+
+// SpawnTemplate spawns n entities from the template, with the overrides replacing components of the same type or
+// adding new ones.
+func (ecs *ECS) SpawnTemplate(t *Template, n int, overrides ...any) ([]Entity, error) {
+	if t.ecs != ecs {
+		return nil, errors.New("Template belongs to another world")
+	}
+	entities, err := ecs.reserve(n)
+	if err != nil {
+		return nil, err
+	}
+	err = ecs.spawnTemplate(entities, t, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// spawnTemplate inserts entities already handed out by the allocator.
+func (ecs *ECS) spawnTemplate(entities []Entity, t *Template, overrides []any) error {
+	if len(overrides) > 0 {
+		cmps := t.withOverrides(overrides)
+		bitmap, err := ecs.buildCmpsBitmap(cmps)
+		if err != nil {
+			for _, entity := range entities {
+				ecs.allocator.release(entity)
+			}
+			return err
+		}
+		return ecs.spawnReserved(entities, bitmap, cmps)
+	}
+	ecs.mu.Lock()
+	defer ecs.mu.Unlock()
+	tick := ecs.nextTick()
+	for _, entity := range entities {
+		ecs.trackEntity(entity)
+		ecs.appendRow(entity, t.archetype, t.row, tick)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package hayal
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+)
+
+// SystemError is reported to the game's ErrorHandler when a system returns an error, panics or its commands fail to
+// apply.
+type SystemError struct {
+	// System is the name of the system, or the name of its function if it was not Named.
+	System string
+	Step   Stage
+	// Tick is the number of ticks started when the system failed, 0 during Init. It matches Time.Frame.
+	Tick uint64
+	Err  error
+	// Stack is the stack trace of the panic if the system panicked.
+	Stack []byte
+}
+
+func (e *SystemError) Error() string {
+	return fmt.Sprintf("system %s failed in step %s on tick %d: %v", e.System, e.Step, e.Tick, e.Err)
+}
+
+func (e *SystemError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorAction tells the game how to proceed after a system failed.
+type ErrorAction int
+
+const (
+	// ErrorActionContinue keeps running the game and the failed system.
+	ErrorActionContinue ErrorAction = iota
+	// ErrorActionDisable keeps running the game but never runs the failed system again.
+	ErrorActionDisable
+	// ErrorActionStop stops the game gracefully, as if a system called Exit. Deinit still runs.
+	ErrorActionStop
+)
+
+// ErrorHandler decides how the game reacts to a failed system. Handlers run on the game loop once the step of the
+// failed system has finished, so they can safely inspect the world.
+type ErrorHandler = func(err *SystemError) ErrorAction
+
+// LogErrors logs the error and keeps running the system.
+func LogErrors(err *SystemError) ErrorAction {
+	log.Print(err)
+	return ErrorActionContinue
+}
+
+// DisableOnError logs the error and disables the failed system.
+func DisableOnError(err *SystemError) ErrorAction {
+	log.Print(err)
+	return ErrorActionDisable
+}
+
+// StopOnError logs the error and stops the game gracefully. This is the default error handler.
+func StopOnError(err *SystemError) ErrorAction {
+	log.Print(err)
+	return ErrorActionStop
+}
+
+// SetErrorHandler sets how the game reacts to failed systems. Pass one of LogErrors, DisableOnError and StopOnError or
+// a custom handler.
+func (g *Game) SetErrorHandler(handler ErrorHandler) {
+	g.errorHandler = handler
+}
+
+func (sys *scheduledSystem) label() string {
+	if sys.name != "" {
+		return sys.name
+	}
+	return runtime.FuncForPC(reflect.ValueOf(sys.run).Pointer()).Name()
+}
+
+func (g *Game) systemError(step Stage, sys *scheduledSystem, err error) *SystemError {
+	return &SystemError{System: sys.label(), Step: step, Tick: g.ticks, Err: err}
+}
+
+// panicError turns a panic recovered from the named system, or one of its conditions, into a SystemError.
+func (g *Game) panicError(step Stage, label string, r any) *SystemError {
+	return &SystemError{System: label, Step: step, Tick: g.ticks, Err: fmt.Errorf("panic: %v", r), Stack: debug.Stack()}
+}
+
+// runSystem runs the system, turning returned errors and panics into a SystemError.
+func (g *Game) runSystem(step Stage, sys *scheduledSystem) (failure *SystemError) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure = g.panicError(step, sys.label(), r)
+		}
+	}()
+	if err := sys.run(sys.ctx); err != nil {
+		return g.systemError(step, sys, err)
+	}
+	return nil
+}
+
+// handleError reacts to the failure of sys, which is nil if the failure doesn't belong to a system.
+func (g *Game) handleError(sys *scheduledSystem, err *SystemError) {
+	switch g.errorHandler(err) {
+	case ErrorActionDisable:
+		if sys != nil {
+			sys.disabled = true
+		}
+	case ErrorActionStop:
+		g.ctx.Exit()
+	}
+}
@@ -6,12 +6,41 @@
 //
 //	game := hayal.New()
 //	game.AddSystem(hayal.GameLoopStepUpdate, system)
+//	game.SetTargetFPS(60)
 //	game.Run()
 //
-// The system functions have access to a gameCtx that can be used to interface with the game world.
+// Tests and dedicated servers can drive the game tick by tick with Step, or for a number of ticks with RunFor.
+//
+// Systems of a step run in parallel unless they conflict. A system declares the components and resources it accesses,
+// directly or through the typed queries it iterates, and can be ordered relative to other named systems:
+//
+//	query, err := ecs.NewQuery2[transform, velocity](game.World(), ecs.ReadOnly[velocity]())
+//	game.AddSystem(hayal.GameLoopStateUpdate, move, hayal.Named("move"), hayal.After("input"), hayal.Uses(query))
+//
+// Custom stages can be inserted around the built-in ones, and systems or whole stages can be made to run only under
+// some condition:
+//
+//	game.AddStageAfter(hayal.GameLoopStateUpdate, "PostUpdate")
+//	game.AddSystem("PostUpdate", sync, hayal.RunEvery(10))
+//	game.RunStageIf("PostUpdate", connected)
+//
+// Games with menus, loading screens or pause modes can add state machines. State transitions queued with SetNextState
+// are applied right after PreUpdate:
+//
+//	hayal.AddState(&game, Menu)
+//	hayal.AddSystemOnEnter(&game, Playing, spawnLevel)
+//	game.AddSystem(hayal.GameLoopStateUpdate, move, hayal.RunIf(hayal.InState(Playing)))
+//
+// The system functions have access to a gameCtx that can be used to interface with the game world. Systems of a step
+// run in parallel, so structural changes such as Spawn or Destroy are recorded and applied once the step completes.
 //
 //  func System(ctx *gameCtx) {
-//    e, err := ctx.Spawn(transform{x: 5, y: 10})
+//    e, err := ctx.Spawn(transform{x: 5, y: 10}, velocity{x: 1})
+//    if err != nil {
+//      return err
+//    }
+//
+//    _, err = ctx.SpawnBatch(100, bulletBundle{})
 //    if err != nil {
 //      return err
 //    }
@@ -45,6 +74,33 @@
 //      if err != nil {
 //        return err
 //      }
+//
+//      ptr, err := GetMut[transform](&entity)
+//      if err != nil {
+//        return err
+//      }
+//      ptr.x++
+//    }
+//
+//    query, err := ecs.NewQuery2[transform, velocity](ctx.World(), ecs.Without[frozen]())
+//    if err != nil {
+//      return err
+//    }
+//    for row := range query.Iter() {
+//      row.C1.x += row.C2.x
+//      row.Mark()
+//    }
+//
+//    ecs.SendEvent(ctx.World(), collision{a: e, b: e})
+//    for _, event := range collisions.Read() {
+//      ...
+//    }
+//
+//    err = ecs.ResourceMut(ctx.World(), func(s *score) {
+//      s.points++
+//    })
+//    if err != nil {
+//      return err
 //    }
 //
 //    ctx.Exit()
@@ -53,36 +109,97 @@
 package hayal
 
 import (
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/otanriverdi/hayal/ecs"
 )
 
-type gameLoopStep = uint
+// Stage names a group of systems that run together in the game loop. The built-in stages are the GameLoopStep*
+// constants, custom stages can be inserted around them with AddStageBefore and AddStageAfter.
+type Stage string
 
 const (
 	// GameLoopStepInit runs once on game start.
-	GameLoopStepInit gameLoopStep = iota
+	GameLoopStepInit Stage = "Init"
 	// GameLoopStepPreUpdate runs first on every tick. This is where we update resources that would be used in the
-	// update stage.
-	GameLoopStepPreUpdate
+	// update stage. State transitions are applied right after it.
+	GameLoopStepPreUpdate Stage = "PreUpdate"
+	// GameLoopStepFixedUpdate runs zero or more times on every tick after PreUpdate, once for every fixed timestep
+	// that passed since the previous tick. This is where we update physics and other logic that needs to be independent
+	// of the frame rate.
+	GameLoopStepFixedUpdate Stage = "FixedUpdate"
 	// GameLoopStateUpdate runs on every tick. This is where we update game play systems.
-	GameLoopStateUpdate
+	GameLoopStateUpdate Stage = "Update"
 	// GameLoopStateDraw runs on every tick after Update. This is where we render and apply component updates.
-	GameLoopStateDraw
+	GameLoopStateDraw Stage = "Draw"
 	// GameLoopStateDeinit runs once before exit. Use this for cleanup.
-	GameLoopStateDeinit
+	GameLoopStateDeinit Stage = "Deinit"
 )
 
 type gameCtx struct {
 	ecs.ECS
-	exit chan struct{}
+	exit     chan struct{}
+	exitOnce sync.Once
 }
 
 func (ctx *gameCtx) Exit() {
-	close(ctx.exit)
+	ctx.exitOnce.Do(func() {
+		close(ctx.exit)
+	})
+}
+
+// systemCtx is the context of a single scheduled system. It defers structural changes into the system's own command
+// buffer, so systems running in parallel never mutate the archetypes while others iterate them.
+type systemCtx struct {
+	*gameCtx
+	commands *ecs.Commands
+}
+
+func (ctx *systemCtx) Spawn(cmps ...any) (ecs.Entity, error) {
+	return ctx.commands.Spawn(cmps...)
+}
+
+func (ctx *systemCtx) SpawnBatch(n int, cmps ...any) ([]ecs.Entity, error) {
+	return ctx.commands.SpawnBatch(n, cmps...)
+}
+
+func (ctx *systemCtx) SpawnTemplate(t *ecs.Template, n int, overrides ...any) ([]ecs.Entity, error) {
+	return ctx.commands.SpawnTemplate(t, n, overrides...)
+}
+
+func (ctx *systemCtx) Destroy(entity ecs.Entity) error {
+	return ctx.commands.Destroy(entity)
+}
+
+func (ctx *systemCtx) AddComponent(entity ecs.Entity, cmp any) error {
+	return ctx.commands.AddComponent(entity, cmp)
+}
+
+func (ctx *systemCtx) RemoveComponent(entity ecs.Entity, cmp any) error {
+	return ctx.commands.RemoveComponent(entity, cmp)
+}
+
+func (ctx *systemCtx) SetParent(child ecs.Entity, parent ecs.Entity) error {
+	return ctx.commands.SetParent(child, parent)
+}
+
+func (ctx *systemCtx) RemoveParent(child ecs.Entity) error {
+	return ctx.commands.RemoveParent(child)
+}
+
+func (ctx *systemCtx) DestroyRecursive(entity ecs.Entity) error {
+	return ctx.commands.DestroyRecursive(entity)
+}
+
+func (ctx *systemCtx) Commands() *ecs.Commands {
+	return ctx.commands
 }
 
+// SystemCtx is passed into every system. Structural changes made through it are recorded into the system's Commands
+// and applied once every system of the step has finished, in the order the systems were added. Entities spawned in a
+// step can't be queried until the next one.
 type SystemCtx interface {
 	ecs.SystemCtx
 	// Exit signals the game to run cleanup and exit gracefully.
@@ -93,59 +210,198 @@ type System = func(ctx SystemCtx) error
 
 type Game struct {
 	ctx *gameCtx
-	// len of first dimension matches step count
-	schedule [5][]System
+	// In execution order
+	stages   []*stage
+	clock    Clock
+	lastTick time.Time
+	ticks    uint64
+	// Zero when frames are not paced
+	frameDuration time.Duration
+	nextFrame     time.Time
+	started       bool
+	shutdown      bool
+	errorHandler  ErrorHandler
+	// By state type
+	states map[reflect.Type]anyStateMachine
+	// In the order they were added
+	stateMachines []anyStateMachine
 }
 
 // New initializes a new game.
 func New() Game {
-	return Game{ctx: &gameCtx{ECS: ecs.New()}}
+	g := Game{ctx: &gameCtx{ECS: ecs.New(), exit: make(chan struct{})}, clock: wallClock{}, errorHandler: StopOnError}
+	g.states = make(map[reflect.Type]anyStateMachine)
+	g.stages = []*stage{
+		g.newStage(GameLoopStepInit, stageStartup),
+		g.newStage(GameLoopStepPreUpdate, stageFrame),
+		g.newStage(GameLoopStepFixedUpdate, stageFixed),
+		g.newStage(GameLoopStateUpdate, stageFrame),
+		g.newStage(GameLoopStateDraw, stageFrame),
+		g.newStage(GameLoopStateDeinit, stageShutdown),
+	}
+	ecs.InsertResource(g.World(), Time{})
+	ecs.InsertResource(g.World(), FixedTime{Step: defaultFixedTimestep})
+	return g
+}
+
+// World returns the world of the game, to prepare typed queries and insert resources before the game runs.
+func (g *Game) World() *ecs.ECS {
+	return &g.ctx.ECS
 }
 
 // AddSystem adds a system to the schedule to be executed in various steps of the game loop. Check GameLoopStep*
-// constants for various steps and when they run.
-func (g *Game) AddSystem(step gameLoopStep, system System) {
-	if g.schedule[step] == nil {
-		g.schedule[step] = make([]System, 0)
+// constants for various steps and when they run, or add custom stages with AddStageBefore and AddStageAfter. Use
+// options such as Uses, Named and After to let systems of the same step run in parallel and order them, and RunIf to
+// only run them under some condition.
+func (g *Game) AddSystem(step Stage, system System, opts ...SystemOption) {
+	g.addSystem(g.mustStage(step), system, opts)
+}
+
+func (g *Game) addSystem(st *stage, system System, opts []SystemOption) {
+	sys := &scheduledSystem{run: system, ctx: g.newSystemCtx()}
+	for _, opt := range opts {
+		opt(sys)
 	}
-	g.schedule[step] = append(g.schedule[step], system)
+	st.systems = append(st.systems, sys)
+	st.plan = nil
+	st.planErr = nil
 }
 
-// Run starts the schedule and the execution of the game.
+func (g *Game) newSystemCtx() *systemCtx {
+	return &systemCtx{gameCtx: g.ctx, commands: ecs.NewCommands(&g.ctx.ECS)}
+}
+
+// Run starts the schedule and the execution of the game. It runs ticks until a system calls Exit, then runs Deinit.
 func (g *Game) Run() {
-	g.executeStep(GameLoopStepInit)
-	for {
-		select {
-		case <-g.ctx.exit:
-			g.executeStep(GameLoopStateDeinit)
-			return
-		default:
-			g.executeStep(GameLoopStepPreUpdate)
-			g.executeStep(GameLoopStateUpdate)
-			g.executeStep(GameLoopStateDraw)
+	g.start()
+	for !g.exiting() {
+		g.tick()
+		g.pace()
+	}
+	g.Shutdown()
+}
+
+// RunFor runs the game like Run, but for at most n ticks. Use it for integration tests of gameplay or to run the game
+// headless.
+func (g *Game) RunFor(n int) {
+	g.start()
+	for i := 0; i < n && !g.exiting(); i++ {
+		g.tick()
+		g.pace()
+	}
+	g.Shutdown()
+}
+
+// Step runs exactly one tick of the game, running Init first if the game hasn't started yet. Steps are not paced by
+// the target frame rate and Deinit only runs once Shutdown is called.
+func (g *Game) Step() {
+	if g.shutdown {
+		return
+	}
+	g.start()
+	g.tick()
+}
+
+// Shutdown runs Deinit, if the game started and hasn't been shut down yet.
+func (g *Game) Shutdown() {
+	if !g.started || g.shutdown {
+		return
+	}
+	g.shutdown = true
+	for _, st := range g.stages {
+		if st.kind == stageShutdown {
+			g.runStage(st)
 		}
 	}
 }
 
-type Plugin = func(g *Game)
+// SetTargetFPS limits Run and RunFor to the passed in number of ticks per second by sleeping on the clock between
+// ticks. Zero, the default, runs ticks as fast as possible.
+func (g *Game) SetTargetFPS(fps int) {
+	g.frameDuration = 0
+	if fps > 0 {
+		g.frameDuration = time.Second / time.Duration(fps)
+	}
+}
 
-func (g *Game) Plug(plugin Plugin) {
-	plugin(g)
+func (g *Game) start() {
+	if g.started {
+		return
+	}
+	g.started = true
+	// Ordering mistakes are reported before anything runs, instead of when a stage first runs deep into the game.
+	for _, st := range g.allStages() {
+		g.planStage(st)
+	}
+	for _, st := range g.stages {
+		if st.kind == stageStartup {
+			g.runStage(st)
+		}
+	}
+	for _, m := range g.stateMachines {
+		m.enter(g)
+	}
+}
+
+func (g *Game) exiting() bool {
+	select {
+	case <-g.ctx.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// pace sleeps until the next frame is due. Frames are scheduled on a fixed grid so sleeping inaccuracies don't
+// accumulate, unless the game falls behind by more than a frame.
+func (g *Game) pace() {
+	if g.frameDuration <= 0 {
+		return
+	}
+	now := g.clock.Now()
+	if g.nextFrame.IsZero() || now.Sub(g.nextFrame) > g.frameDuration {
+		g.nextFrame = now
+	}
+	g.nextFrame = g.nextFrame.Add(g.frameDuration)
+	if wait := g.nextFrame.Sub(now); wait > 0 {
+		g.clock.Sleep(wait)
+	}
 }
 
-func (g *Game) executeStep(step gameLoopStep) {
-	var wg sync.WaitGroup
-	for _, sys := range g.schedule[GameLoopStepInit] {
-		wg.Add(1)
-		go func(sys System) {
-			defer wg.Done()
-			err := sys(g.ctx)
-			if err != nil {
-				panic(err)
+func (g *Game) tick() {
+	g.ctx.UpdateEvents()
+	fixedRuns := g.advanceTime()
+	for i := 0; i < len(g.stages); i++ {
+		switch g.stages[i].kind {
+		case stageFrame:
+			g.runStage(g.stages[i])
+			if g.stages[i].name == GameLoopStepPreUpdate {
+				for _, m := range g.stateMachines {
+					m.transition(g)
+				}
 			}
-		}(sys)
+		case stageFixed:
+			// Fixed stages are always next to each other and run as a group.
+			end := i
+			for end < len(g.stages) && g.stages[end].kind == stageFixed {
+				end++
+			}
+			for range fixedRuns {
+				for _, st := range g.stages[i:end] {
+					g.runStage(st)
+				}
+				g.advanceFixedTime()
+			}
+			g.updateAlpha()
+			i = end - 1
+		}
 	}
-	wg.Wait()
+}
+
+type Plugin = func(g *Game)
+
+func (g *Game) Plug(plugin Plugin) {
+	plugin(g)
 }
 
 // GetComponent extracts a copy of component data from the passed in query result.
@@ -153,6 +409,12 @@ func GetComponent[C any](qr *ecs.QueryResult) (C, error) {
 	return ecs.GetComponent[C](qr)
 }
 
+// GetMut returns a pointer to the component data of the passed in query result, to update it in place. It is only
+// valid until the next structural change.
+func GetMut[C any](qr *ecs.QueryResult) (*C, error) {
+	return ecs.GetMut[C](qr)
+}
+
 // SetComponent sets the component data to be the passed in component.
 func SetComponent(qr *ecs.QueryResult, cmp any) error {
 	return ecs.SetComponent(qr, cmp)
@@ -0,0 +1,571 @@
+package hayal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/otanriverdi/hayal/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	type transform struct {
+		x int
+	}
+	type velocity struct {
+		x int
+	}
+
+	exit := func(ctx SystemCtx) error {
+		ctx.Exit()
+		return nil
+	}
+
+	t.Run("orders systems with before and after", func(t *testing.T) {
+		game := New()
+		var mu sync.Mutex
+		var order []string
+		record := func(name string) System {
+			return func(ctx SystemCtx) error {
+				mu.Lock()
+				defer mu.Unlock()
+				order = append(order, name)
+				return nil
+			}
+		}
+		game.AddSystem(GameLoopStepInit, record("render"), Named("render"), After("physics"), Uses())
+		game.AddSystem(GameLoopStepInit, record("physics"), Named("physics"), After("input"), Uses())
+		game.AddSystem(GameLoopStepInit, record("input"), Named("input"), Before("physics"), Uses())
+		game.AddSystem(GameLoopStateUpdate, exit)
+		game.Run()
+		assert.Equal(t, []string{"input", "physics", "render"}, order)
+	})
+
+	t.Run("runs conflicting systems one at a time", func(t *testing.T) {
+		game := New()
+		var running, maxRunning atomic.Int32
+		write := func(ctx SystemCtx) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		}
+		for range 4 {
+			game.AddSystem(GameLoopStepInit, write, Uses(ecs.WriteComponent[transform]()))
+		}
+		game.AddSystem(GameLoopStateUpdate, exit)
+		game.Run()
+		assert.Equal(t, int32(1), maxRunning.Load())
+	})
+
+	t.Run("runs non-conflicting systems in parallel", func(t *testing.T) {
+		game := New()
+		transforms, err := ecs.NewQuery1[transform](game.World(), ecs.ReadOnly[transform]())
+		assert.NoError(t, err)
+		velocities, err := ecs.NewQuery2[transform, velocity](game.World(), ecs.ReadOnly[transform]())
+		assert.NoError(t, err)
+		rendezvous := make(chan struct{})
+		var met atomic.Int32
+		meet := func(ctx SystemCtx) error {
+			select {
+			case rendezvous <- struct{}{}:
+				met.Add(1)
+			case <-rendezvous:
+				met.Add(1)
+			case <-time.After(time.Second):
+			}
+			return nil
+		}
+		game.AddSystem(GameLoopStepInit, meet, Uses(transforms))
+		game.AddSystem(GameLoopStepInit, meet, Uses(velocities))
+		game.AddSystem(GameLoopStateUpdate, exit)
+		game.Run()
+		assert.Equal(t, int32(2), met.Load())
+	})
+
+	t.Run("rejects cycles", func(t *testing.T) {
+		game := New()
+		noop := func(ctx SystemCtx) error { return nil }
+		game.AddSystem(GameLoopStepInit, noop, Named("a"), After("b"))
+		game.AddSystem(GameLoopStepInit, noop, Named("b"), After("a"))
+		_, err := game.buildPlan(game.mustStage(GameLoopStepInit))
+		assert.Error(t, err)
+	})
+
+	t.Run("reports invalid plans on start", func(t *testing.T) {
+		type mode int
+		game := New()
+		var reported []*SystemError
+		game.SetErrorHandler(func(err *SystemError) ErrorAction {
+			reported = append(reported, err)
+			return ErrorActionStop
+		})
+		noop := func(ctx SystemCtx) error { return nil }
+		AddState(&game, mode(0))
+		AddSystemOnEnter(&game, mode(1), noop, Named("spawn"))
+		game.AddSystem(GameLoopStateDraw, noop, Named("draw"))
+		game.AddSystem(GameLoopStepPreUpdate, noop, After("sav"))
+		game.AddSystem(GameLoopStateUpdate, noop, After("draw"))
+		game.AddSystem(GameLoopStateDeinit, noop, Before("spawn"))
+		assert.NotPanics(t, func() {
+			game.RunFor(5)
+		})
+		assert.Len(t, reported, 3)
+		assert.Equal(t, GameLoopStepPreUpdate, reported[0].Step)
+		assert.EqualError(t, reported[0].Err, `Unknown system "sav" in ordering constraint`)
+		assert.Equal(t, GameLoopStateUpdate, reported[1].Step)
+		assert.EqualError(t, reported[1].Err, `System "draw" in ordering constraint is not in stage "Update"`)
+		assert.EqualError(t, reported[2].Err, `System "spawn" in ordering constraint is not in stage "Deinit"`)
+		assert.Equal(t, uint64(0), game.ticks)
+	})
+}
+
+func TestTime(t *testing.T) {
+	t.Run("runs fixed steps from the accumulator", func(t *testing.T) {
+		game := New()
+		clock := NewManualClock(time.Unix(0, 0))
+		game.SetClock(clock)
+		game.SetFixedTimestep(10 * time.Millisecond)
+		var fixedRuns []int
+		var alphas []float64
+		var frames []uint64
+		current := 0
+		game.AddSystem(GameLoopStepPreUpdate, func(ctx SystemCtx) error {
+			fixedRuns = append(fixedRuns, 0)
+			current = len(fixedRuns) - 1
+			return nil
+		})
+		game.AddSystem(GameLoopStepFixedUpdate, func(ctx SystemCtx) error {
+			fixedRuns[current]++
+			return nil
+		})
+		game.AddSystem(GameLoopStateDraw, func(ctx SystemCtx) error {
+			fixed, err := ecs.Resource[FixedTime](ctx.World())
+			if err != nil {
+				return err
+			}
+			alphas = append(alphas, fixed.Alpha)
+			tm, err := ecs.Resource[Time](ctx.World())
+			if err != nil {
+				return err
+			}
+			frames = append(frames, tm.Frame)
+			clock.Advance(15 * time.Millisecond)
+			if tm.Frame == 4 {
+				ctx.Exit()
+			}
+			return nil
+		})
+		game.Run()
+		assert.Equal(t, []int{0, 1, 2, 1}, fixedRuns)
+		assert.InDeltaSlice(t, []float64{0, 0.5, 0, 0.5}, alphas, 1e-9)
+		assert.Equal(t, []uint64{1, 2, 3, 4}, frames)
+		tm, err := ecs.Resource[Time](game.World())
+		assert.NoError(t, err)
+		assert.Equal(t, 45*time.Millisecond, tm.Elapsed)
+		assert.Equal(t, 15*time.Millisecond, tm.Delta)
+	})
+
+	t.Run("caps fixed runs per frame", func(t *testing.T) {
+		game := New()
+		assert.Panics(t, func() {
+			game.SetFixedTimestep(0)
+		})
+		clock := NewManualClock(time.Unix(0, 0))
+		game.SetClock(clock)
+		game.SetFixedTimestep(time.Millisecond)
+		runs := 0
+		game.AddSystem(GameLoopStepFixedUpdate, func(ctx SystemCtx) error {
+			runs++
+			return nil
+		})
+		game.Step()
+		clock.Advance(100*time.Millisecond + time.Millisecond/2)
+		game.Step()
+		assert.Equal(t, maxFixedRuns, runs)
+		fixed, err := ecs.Resource[FixedTime](game.World())
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(maxFixedRuns)*time.Millisecond, fixed.Elapsed)
+		assert.InDelta(t, 0.5, fixed.Alpha, 1e-9, "the time beyond the cap is dropped")
+	})
+}
+
+func TestRun(t *testing.T) {
+	type counter struct {
+		init, ticks, deinit int
+	}
+	countingGame := func() (*Game, *counter) {
+		game := New()
+		c := &counter{}
+		game.AddSystem(GameLoopStepInit, func(ctx SystemCtx) error {
+			c.init++
+			return nil
+		})
+		game.AddSystem(GameLoopStateUpdate, func(ctx SystemCtx) error {
+			c.ticks++
+			return nil
+		})
+		game.AddSystem(GameLoopStateDeinit, func(ctx SystemCtx) error {
+			c.deinit++
+			return nil
+		})
+		return &game, c
+	}
+
+	t.Run("steps one tick at a time", func(t *testing.T) {
+		game, c := countingGame()
+		game.Step()
+		game.Step()
+		assert.Equal(t, counter{init: 1, ticks: 2}, *c)
+		game.Shutdown()
+		game.Shutdown()
+		game.Step()
+		assert.Equal(t, counter{init: 1, ticks: 2, deinit: 1}, *c)
+	})
+
+	t.Run("runs for n ticks", func(t *testing.T) {
+		game, c := countingGame()
+		game.RunFor(5)
+		assert.Equal(t, counter{init: 1, ticks: 5, deinit: 1}, *c)
+	})
+
+	t.Run("stops early on exit", func(t *testing.T) {
+		game, c := countingGame()
+		game.AddSystem(GameLoopStateDraw, func(ctx SystemCtx) error {
+			if c.ticks == 2 {
+				ctx.Exit()
+			}
+			return nil
+		})
+		game.RunFor(5)
+		assert.Equal(t, counter{init: 1, ticks: 2, deinit: 1}, *c)
+	})
+
+	t.Run("paces ticks to the target frame rate", func(t *testing.T) {
+		game, _ := countingGame()
+		clock := NewManualClock(time.Unix(0, 0))
+		game.SetClock(clock)
+		game.SetTargetFPS(20)
+		game.RunFor(4)
+		assert.Equal(t, time.Unix(0, 0).Add(200*time.Millisecond), clock.Now())
+		tm, err := ecs.Resource[Time](game.World())
+		assert.NoError(t, err)
+		assert.Equal(t, 150*time.Millisecond, tm.Elapsed)
+		assert.Equal(t, 50*time.Millisecond, tm.Delta)
+	})
+}
+
+func TestErrorHandling(t *testing.T) {
+	failing := func(ctx SystemCtx) error {
+		return errors.New("boom")
+	}
+
+	t.Run("stops gracefully by default", func(t *testing.T) {
+		game := New()
+		deinit := false
+		game.AddSystem(GameLoopStateUpdate, failing)
+		game.AddSystem(GameLoopStateDeinit, func(ctx SystemCtx) error {
+			deinit = true
+			return nil
+		})
+		game.RunFor(10)
+		assert.True(t, deinit)
+		assert.Equal(t, uint64(1), game.ticks)
+	})
+
+	t.Run("disables failing systems", func(t *testing.T) {
+		game := New()
+		game.SetErrorHandler(func(err *SystemError) ErrorAction {
+			return ErrorActionDisable
+		})
+		runs := 0
+		game.AddSystem(GameLoopStateUpdate, func(ctx SystemCtx) error {
+			runs++
+			return errors.New("boom")
+		})
+		game.RunFor(3)
+		assert.Equal(t, 1, runs)
+	})
+
+	t.Run("reports panics with system, step and tick", func(t *testing.T) {
+		game := New()
+		var reported []*SystemError
+		game.SetErrorHandler(func(err *SystemError) ErrorAction {
+			reported = append(reported, err)
+			return ErrorActionContinue
+		})
+		var frames []uint64
+		game.AddSystem(GameLoopStateDraw, func(ctx SystemCtx) error {
+			tm, err := ecs.Resource[Time](ctx.World())
+			if err != nil {
+				return err
+			}
+			frames = append(frames, tm.Frame)
+			panic("oops")
+		}, Named("renderer"))
+		game.AddSystem(GameLoopStepInit, failing)
+		game.RunFor(2)
+		assert.Equal(t, []uint64{1, 2}, frames)
+		assert.Len(t, reported, 3)
+		assert.Equal(t, GameLoopStepInit, reported[0].Step)
+		assert.Equal(t, uint64(0), reported[0].Tick)
+		assert.Contains(t, reported[0].System, "TestErrorHandling")
+		assert.EqualError(t, reported[0].Err, "boom")
+		assert.Equal(t, "renderer", reported[2].System)
+		assert.Equal(t, GameLoopStateDraw, reported[2].Step)
+		assert.Equal(t, uint64(2), reported[2].Tick, "ticks are numbered like Time.Frame")
+		assert.NotEmpty(t, reported[2].Stack)
+		assert.Contains(t, reported[2].Error(), "system renderer failed in step Draw on tick 2: panic: oops")
+	})
+
+	t.Run("reports failing commands", func(t *testing.T) {
+		game := New()
+		var reported []*SystemError
+		game.SetErrorHandler(func(err *SystemError) ErrorAction {
+			reported = append(reported, err)
+			return ErrorActionContinue
+		})
+		game.AddSystem(GameLoopStepInit, func(ctx SystemCtx) error {
+			return ctx.Destroy(ecs.Entity{})
+		}, Named("destroyer"))
+		game.RunFor(0)
+		assert.Len(t, reported, 1)
+		assert.Equal(t, "destroyer", reported[0].System)
+	})
+}
+
+func TestStages(t *testing.T) {
+	record := func(order *[]string, name string) System {
+		return func(ctx SystemCtx) error {
+			*order = append(*order, name)
+			return nil
+		}
+	}
+
+	t.Run("runs custom stages around the built-in ones", func(t *testing.T) {
+		game := New()
+		var order []string
+		game.AddStageAfter(GameLoopStateUpdate, "PostUpdate")
+		game.AddStageBefore("PostUpdate", "Network")
+		game.AddStageBefore(GameLoopStepInit, "Setup")
+		game.AddSystem(GameLoopStepInit, record(&order, "init"))
+		game.AddSystem("Setup", record(&order, "setup"))
+		game.AddSystem(GameLoopStateDraw, record(&order, "draw"))
+		game.AddSystem("PostUpdate", record(&order, "post"))
+		game.AddSystem("Network", record(&order, "network"))
+		game.AddSystem(GameLoopStateUpdate, record(&order, "update"))
+		game.RunFor(1)
+		assert.Equal(t, []string{"setup", "init", "update", "network", "post", "draw"}, order)
+	})
+
+	t.Run("runs stages next to fixed update per fixed step", func(t *testing.T) {
+		game := New()
+		clock := NewManualClock(time.Unix(0, 0))
+		game.SetClock(clock)
+		game.SetFixedTimestep(10 * time.Millisecond)
+		var order []string
+		game.AddStageAfter(GameLoopStepFixedUpdate, "Physics")
+		game.AddSystem(GameLoopStepFixedUpdate, record(&order, "fixed"))
+		game.AddSystem("Physics", record(&order, "physics"))
+		game.AddSystem(GameLoopStateDraw, func(ctx SystemCtx) error {
+			clock.Advance(20 * time.Millisecond)
+			return nil
+		})
+		game.RunFor(2)
+		assert.Equal(t, []string{"fixed", "physics", "fixed", "physics"}, order)
+	})
+
+	t.Run("rejects unknown and duplicate stages", func(t *testing.T) {
+		game := New()
+		assert.PanicsWithValue(t, `Unknown stage "Physics"`, func() {
+			game.AddSystem("Physics", record(new([]string), "physics"))
+		})
+		assert.PanicsWithValue(t, `Unknown stage "Physics"`, func() {
+			game.AddStageAfter("Physics", "Network")
+		})
+		assert.PanicsWithValue(t, `Duplicate stage "Update"`, func() {
+			game.AddStageAfter(GameLoopStateDraw, GameLoopStateUpdate)
+		})
+	})
+
+	t.Run("runs systems and stages only when their conditions hold", func(t *testing.T) {
+		game := New()
+		var order []string
+		enabled := false
+		game.AddStageAfter(GameLoopStateUpdate, "Debug")
+		game.RunStageIf("Debug", func(ctx SystemCtx) bool {
+			return enabled
+		})
+		game.AddSystem("Debug", record(&order, "debug"))
+		game.AddSystem(GameLoopStateUpdate, record(&order, "every"), RunEvery(2))
+		game.AddSystem(GameLoopStateUpdate, record(&order, "once"), RunOnce())
+		game.AddSystem(GameLoopStateUpdate, record(&order, "never"), RunIf(func(ctx SystemCtx) bool {
+			return false
+		}))
+		game.AddSystem(GameLoopStateDraw, func(ctx SystemCtx) error {
+			enabled = !enabled
+			return nil
+		})
+		for range 4 {
+			game.Step()
+			order = append(order, "|")
+		}
+		assert.Equal(t, []string{"every", "once", "|", "debug", "|", "every", "|", "debug", "|"}, order)
+		assert.PanicsWithValue(t, "Invalid interval 0, must be positive", func() {
+			RunEvery(0)
+		})
+	})
+
+	t.Run("reports failing commands of stage conditions", func(t *testing.T) {
+		game := New()
+		var reported []*SystemError
+		game.SetErrorHandler(func(err *SystemError) ErrorAction {
+			reported = append(reported, err)
+			return ErrorActionContinue
+		})
+		game.AddStageAfter(GameLoopStateUpdate, "Debug")
+		game.RunStageIf("Debug", func(ctx SystemCtx) bool {
+			ctx.Destroy(ecs.Entity{})
+			return true
+		})
+		game.Step()
+		assert.Len(t, reported, 1)
+		assert.Equal(t, "RunStageIf(Debug)", reported[0].System)
+		assert.Equal(t, Stage("Debug"), reported[0].Step)
+	})
+
+	t.Run("recovers from panicking conditions", func(t *testing.T) {
+		game := New()
+		var reported []*SystemError
+		game.SetErrorHandler(func(err *SystemError) ErrorAction {
+			reported = append(reported, err)
+			return ErrorActionDisable
+		})
+		game.AddStageAfter(GameLoopStateUpdate, "Debug")
+		game.RunStageIf("Debug", func(ctx SystemCtx) bool {
+			panic("no debugger")
+		})
+		runs := 0
+		game.AddSystem(GameLoopStateUpdate, func(ctx SystemCtx) error {
+			runs++
+			return nil
+		}, Named("flaky"), RunIf(func(ctx SystemCtx) bool {
+			panic("no input")
+		}))
+		assert.NotPanics(t, func() {
+			game.RunFor(2)
+		})
+		assert.Equal(t, 0, runs)
+		assert.Len(t, reported, 3, "disabled systems don't evaluate their conditions")
+		assert.Equal(t, "flaky", reported[0].System)
+		assert.EqualError(t, reported[0].Err, "panic: no input")
+		assert.NotEmpty(t, reported[0].Stack)
+		assert.Equal(t, "RunStageIf(Debug)", reported[1].System)
+		assert.Equal(t, "RunStageIf(Debug)", reported[2].System)
+	})
+}
+
+func TestState(t *testing.T) {
+	type mode int
+	const (
+		menu mode = iota
+		playing
+		paused
+	)
+	type enemy struct{}
+
+	t.Run("runs enter, exit and in state systems", func(t *testing.T) {
+		game := New()
+		AddState(&game, menu)
+		var order []string
+		record := func(name string) System {
+			return func(ctx SystemCtx) error {
+				order = append(order, name)
+				return nil
+			}
+		}
+		AddSystemOnEnter(&game, menu, record("enter menu"))
+		AddSystemOnExit(&game, menu, record("exit menu"))
+		AddSystemOnEnter(&game, playing, record("enter playing"))
+		game.AddSystem(GameLoopStepPreUpdate, func(ctx SystemCtx) error {
+			return SetNextState(ctx, playing)
+		}, RunOnce())
+		game.AddSystem(GameLoopStateUpdate, record("menu"), RunIf(InState(menu)))
+		game.AddSystem(GameLoopStateUpdate, record("playing"), RunIf(InState(playing)))
+		game.RunFor(2)
+		assert.Equal(t, []string{"enter menu", "exit menu", "enter playing", "playing", "playing"}, order)
+		state, err := ecs.Resource[State[mode]](game.World())
+		assert.NoError(t, err)
+		assert.Equal(t, playing, state.Current)
+	})
+
+	t.Run("destroys state scoped entities on exit", func(t *testing.T) {
+		game := New()
+		AddState(&game, playing)
+		var scoped, kept []ecs.Entity
+		var child, nested ecs.Entity
+		changed, err := ecs.NewQuery1[StateScoped[mode]](game.World(), ecs.Changed[StateScoped[mode]]())
+		assert.NoError(t, err)
+		AddSystemOnEnter(&game, playing, func(ctx SystemCtx) error {
+			var err error
+			scoped, err = ctx.SpawnBatch(3, enemy{}, StateScoped[mode]{State: playing})
+			if err != nil {
+				return err
+			}
+			kept, err = ctx.SpawnBatch(2, enemy{}, StateScoped[mode]{State: paused})
+			if err != nil {
+				return err
+			}
+			child, err = ctx.Spawn(enemy{})
+			if err != nil {
+				return err
+			}
+			nested, err = ctx.Spawn(enemy{}, StateScoped[mode]{State: playing})
+			if err != nil {
+				return err
+			}
+			if err := ctx.SetParent(child, scoped[0]); err != nil {
+				return err
+			}
+			return ctx.SetParent(nested, child)
+		})
+		AddSystemOnExit(&game, playing, func(ctx SystemCtx) error {
+			assert.True(t, ctx.IsAlive(scoped[0]))
+			return nil
+		})
+		game.Step()
+		assert.True(t, game.World().IsAlive(scoped[0]))
+		for range changed.Iter() {
+		}
+		assert.NoError(t, ecs.ResourceMut(game.World(), func(n *NextState[mode]) {
+			n.Set(paused)
+		}))
+		game.Step()
+		for _, entity := range append(scoped, child, nested) {
+			assert.False(t, game.World().IsAlive(entity), "scoped entities are destroyed with their descendants")
+		}
+		for _, entity := range kept {
+			assert.True(t, game.World().IsAlive(entity))
+		}
+		for row := range changed.Iter() {
+			assert.Fail(t, "transitions don't change scoped entities", row.Entity)
+		}
+	})
+
+	t.Run("rejects unknown and duplicate states", func(t *testing.T) {
+		game := New()
+		assert.Panics(t, func() {
+			AddSystemOnEnter(&game, menu, func(ctx SystemCtx) error { return nil })
+		})
+		AddState(&game, menu)
+		assert.Panics(t, func() {
+			AddState(&game, playing)
+		})
+	})
+}
@@ -0,0 +1,20 @@
+package scene
+
+import (
+	"github.com/otanriverdi/hayal/assets"
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+// SceneLoader loads *Scene assets from files ending in .scene.yaml.
+func SceneLoader(types *ecs.TypeRegistry, opts ...Option) assets.AssetLoader {
+	return assets.NewLoader(func(data []byte) (*Scene, error) {
+		return Parse(data, types, opts...)
+	}, "scene.yaml")
+}
+
+// PrefabLoader loads *Prefab assets from files ending in .prefab.yaml.
+func PrefabLoader(types *ecs.TypeRegistry, opts ...Option) assets.AssetLoader {
+	return assets.NewLoader(func(data []byte) (*Prefab, error) {
+		return ParsePrefab(data, types, opts...)
+	}, "prefab.yaml")
+}
@@ -0,0 +1,187 @@
+package scene
+
+import (
+	"reflect"
+
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+// Prefab is a reusable entity tree that can be instantiated any number of times. It is written like a single scene
+// entity, and may itself instance other prefabs through the prefab key:
+//
+//	prefab: ship
+//	components:
+//	  Player: {}
+//	children:
+//	  - components:
+//	      Gun: {damage: 5}
+//
+// A prefab is compiled into templates the first time it is instantiated in a world, so later instances are spawned
+// with a single batch insert per entity of the tree. The templates are kept by the world, so prefabs don't keep the
+// worlds they were instantiated in alive. Components holding slices, maps or pointers are decoded again for
+// every instance instead, so instances never share them, which spawns the entities that have them one at a time.
+type Prefab struct {
+	root *entity
+}
+
+// prefabCache is the resource holding the prefabs compiled for a world.
+type prefabCache struct {
+	compiled map[*Prefab]*compiledNode
+}
+
+type compiledNode struct {
+	template *ecs.Template
+	// Components holding references, decoded again for every instance
+	fresh    []component
+	children []*compiledNode
+}
+
+// spawn spawns n instances of the node, with the overrides replacing components of the same type or adding new ones.
+func (node *compiledNode) spawn(ctx Instancer, n int, overrides []any) ([]ecs.Entity, error) {
+	// Invalid counts are reported by SpawnTemplate.
+	if len(node.fresh) == 0 || n < 0 {
+		return ctx.SpawnTemplate(node.template, n, overrides...)
+	}
+	entities := make([]ecs.Entity, 0, n)
+	for range n {
+		cmps := make([]any, 0, len(node.fresh)+len(overrides))
+		for _, c := range node.fresh {
+			cmp, err := c.decode()
+			if err != nil {
+				return nil, err
+			}
+			cmps = append(cmps, cmp)
+		}
+		spawned, err := ctx.SpawnTemplate(node.template, 1, append(cmps, overrides...)...)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, spawned...)
+	}
+	return entities, nil
+}
+
+// hasReferences reports whether values of the type may share memory when copied.
+func hasReferences(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Pointer, reflect.UnsafePointer, reflect.Interface, reflect.Func,
+		reflect.Chan:
+		return true
+	case reflect.Array:
+		return hasReferences(t.Elem())
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if hasReferences(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParsePrefab parses and validates a prefab. Component names are looked up in types.
+func ParsePrefab(data []byte, types *ecs.TypeRegistry, opts ...Option) (*Prefab, error) {
+	p := newParser(types, opts)
+	root, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return &Prefab{root: &entity{}}, nil
+	}
+	e, err := p.parseEntity(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Prefab{root: e}, nil
+}
+
+func (p *Prefab) compile(world *ecs.ECS) (*compiledNode, error) {
+	if _, err := ecs.Resource[prefabCache](world); err != nil {
+		ecs.InsertResource(world, prefabCache{compiled: make(map[*Prefab]*compiledNode)})
+	}
+	var compile func(e *entity) (*compiledNode, error)
+	compile = func(e *entity) (*compiledNode, error) {
+		node := &compiledNode{children: make([]*compiledNode, len(e.children))}
+		cmps := make([]any, len(e.components))
+		for i, c := range e.components {
+			cmp, err := c.decode()
+			if err != nil {
+				return nil, err
+			}
+			cmps[i] = cmp
+			if hasReferences(c.cmpType) {
+				node.fresh = append(node.fresh, c)
+			}
+		}
+		var err error
+		node.template, err = ecs.NewTemplate(world, cmps...)
+		if err != nil {
+			return nil, err
+		}
+		for i, child := range e.children {
+			node.children[i], err = compile(child)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return node, nil
+	}
+	var node *compiledNode
+	var err error
+	_ = ecs.ResourceMut(world, func(cache *prefabCache) {
+		if cached, ok := cache.compiled[p]; ok {
+			node = cached
+			return
+		}
+		node, err = compile(p.root)
+		if err == nil {
+			cache.compiled[p] = node
+		}
+	})
+	return node, err
+}
+
+// Instancer spawns entities from templates and builds their hierarchy. It is implemented by hayal.SystemCtx,
+// ecs.SystemCtx, *ecs.Commands and *ecs.ECS.
+type Instancer interface {
+	SpawnTemplate(t *ecs.Template, n int, overrides ...any) ([]ecs.Entity, error)
+	SetParent(child ecs.Entity, parent ecs.Entity) error
+	World() *ecs.ECS
+}
+
+// Instantiate spawns n instances of the prefab and returns their root entities. The overrides replace components of
+// the same type on the roots, or are added to them. Unlike the components of the prefab, overrides are shared as they
+// are by all the roots.
+func Instantiate(ctx Instancer, prefab *Prefab, n int, overrides ...any) ([]ecs.Entity, error) {
+	root, err := prefab.compile(ctx.World())
+	if err != nil {
+		return nil, err
+	}
+	roots, err := root.spawn(ctx, n, overrides)
+	if err != nil {
+		return nil, err
+	}
+	var spawn func(node *compiledNode, parents []ecs.Entity) error
+	spawn = func(node *compiledNode, parents []ecs.Entity) error {
+		for _, child := range node.children {
+			entities, err := child.spawn(ctx, n, nil)
+			if err != nil {
+				return err
+			}
+			for i, entity := range entities {
+				if err := ctx.SetParent(entity, parents[i]); err != nil {
+					return err
+				}
+			}
+			if err := spawn(child, entities); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := spawn(root, roots); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
@@ -0,0 +1,395 @@
+// Package scene loads entities from declarative YAML files. A scene lists entities by the names their component types
+// are registered under in an ecs.TypeRegistry, and nests children under their parents:
+//
+//	entities:
+//	  - name: ship
+//	    components:
+//	      Position: {x: 10, y: 5}
+//	      Player: {}
+//	    children:
+//	      - components:
+//	          Position: {x: 1}
+//	          Gun: {damage: 3}
+//
+// Component fields are matched by their lowercased name or their yaml tag, like with yaml.Unmarshal.
+package scene
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/otanriverdi/hayal/ecs"
+	"gopkg.in/yaml.v3"
+)
+
+// Error points to the part of a scene file that couldn't be loaded.
+type Error struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func errorAt(node *yaml.Node, format string, args ...any) *Error {
+	return &Error{Line: node.Line, Column: node.Column, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Scene is a parsed scene, ready to be spawned any number of times.
+type Scene struct {
+	entities []*entity
+	// Index of named entities in the spawn order
+	names map[string]int
+}
+
+// Index returns the index of the named entity in the entities returned by SpawnScene.
+func (s *Scene) Index(name string) (int, bool) {
+	idx, ok := s.names[name]
+	return idx, ok
+}
+
+type entity struct {
+	name       string
+	nameNode   *yaml.Node
+	components []component
+	children   []*entity
+}
+
+// component is decoded again on every spawn, so spawned entities never share slices or maps.
+type component struct {
+	cmpType reflect.Type
+	node    *yaml.Node
+}
+
+// clone copies the entity tree for a prefab instance. Names are only meaningful inside the prefab, so they are dropped.
+func (e *entity) clone() *entity {
+	c := &entity{components: slices.Clone(e.components), children: make([]*entity, len(e.children))}
+	for i, child := range e.children {
+		c.children[i] = child.clone()
+	}
+	return c
+}
+
+// override replaces the component of the same type, or adds it.
+func (e *entity) override(c component) {
+	for i := range e.components {
+		if e.components[i].cmpType == c.cmpType {
+			e.components[i] = c
+			return
+		}
+	}
+	e.components = append(e.components, c)
+}
+
+func (c component) decode() (any, error) {
+	v := reflect.New(c.cmpType)
+	if err := c.node.Decode(v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+type parser struct {
+	types   *ecs.TypeRegistry
+	prefabs map[string]*Prefab
+}
+
+// Option configures how scenes and prefabs are parsed.
+type Option func(p *parser)
+
+// WithPrefabs lets entities instance the passed in prefabs by name.
+func WithPrefabs(prefabs map[string]*Prefab) Option {
+	return func(p *parser) {
+		p.prefabs = prefabs
+	}
+}
+
+func newParser(types *ecs.TypeRegistry, opts []Option) *parser {
+	p := &parser{types: types}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// parseDocument returns the root node of the document, or nil if it is empty.
+func parseDocument(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc.Content[0], nil
+}
+
+// Parse parses and validates a scene. Component names are looked up in types.
+func Parse(data []byte, types *ecs.TypeRegistry, opts ...Option) (*Scene, error) {
+	p := newParser(types, opts)
+	root, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	scene := &Scene{names: make(map[string]int)}
+	if root == nil {
+		return scene, nil
+	}
+	fields, err := mapping(root, "entities")
+	if err != nil {
+		return nil, err
+	}
+	if node, ok := fields["entities"]; ok {
+		scene.entities, err = p.parseEntities(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	count := 0
+	var index func(entities []*entity) error
+	index = func(entities []*entity) error {
+		for _, e := range entities {
+			if e.name != "" {
+				if _, ok := scene.names[e.name]; ok {
+					return errorAt(e.nameNode, "Duplicate entity name %q", e.name)
+				}
+				scene.names[e.name] = count
+			}
+			count++
+			if err := index(e.children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := index(scene.entities); err != nil {
+		return nil, err
+	}
+	return scene, nil
+}
+
+func (p *parser) parseEntities(node *yaml.Node) ([]*entity, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, errorAt(node, "Expected a list of entities")
+	}
+	entities := make([]*entity, len(node.Content))
+	for i, item := range node.Content {
+		e, err := p.parseEntity(item)
+		if err != nil {
+			return nil, err
+		}
+		entities[i] = e
+	}
+	return entities, nil
+}
+
+func (p *parser) parseEntity(node *yaml.Node) (*entity, error) {
+	fields, err := mapping(node, "name", "prefab", "components", "children")
+	if err != nil {
+		return nil, err
+	}
+	e := &entity{}
+	if prefab, ok := fields["prefab"]; ok {
+		instanced, ok := p.prefabs[prefab.Value]
+		if !ok {
+			return nil, errorAt(prefab, "Unknown prefab %q", prefab.Value)
+		}
+		e = instanced.root.clone()
+	}
+	if name, ok := fields["name"]; ok {
+		if err := name.Decode(&e.name); err != nil {
+			return nil, err
+		}
+		e.nameNode = name
+	}
+	if cmps, ok := fields["components"]; ok {
+		if cmps.Kind != yaml.MappingNode {
+			return nil, errorAt(cmps, "Expected a mapping of component names to components")
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < len(cmps.Content); i += 2 {
+			key, value := cmps.Content[i], cmps.Content[i+1]
+			cmpType, ok := p.types.Lookup(key.Value)
+			if !ok {
+				return nil, errorAt(key, "Unknown component type %q", key.Value)
+			}
+			if seen[key.Value] {
+				return nil, errorAt(key, "Duplicate component %q", key.Value)
+			}
+			seen[key.Value] = true
+			if err := checkFields(value, cmpType); err != nil {
+				return nil, err
+			}
+			c := component{cmpType: cmpType, node: value}
+			if _, err := c.decode(); err != nil {
+				return nil, errorAt(value, "Invalid component %q: %v", key.Value, err)
+			}
+			e.override(c)
+		}
+	}
+	if children, ok := fields["children"]; ok {
+		parsed, err := p.parseEntities(children)
+		if err != nil {
+			return nil, err
+		}
+		e.children = append(e.children, parsed...)
+	}
+	return e, nil
+}
+
+// mapping returns the values of the mapping node by key, rejecting keys that are not allowed.
+func mapping(node *yaml.Node, allowed ...string) (map[string]*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, errorAt(node, "Expected a mapping")
+	}
+	fields := make(map[string]*yaml.Node)
+	for i := 0; i < len(node.Content); i += 2 {
+		key := node.Content[i]
+		found := false
+		for _, name := range allowed {
+			found = found || key.Value == name
+		}
+		if !found {
+			return nil, errorAt(key, "Unknown field %q", key.Value)
+		}
+		fields[key.Value] = node.Content[i+1]
+	}
+	return fields, nil
+}
+
+var (
+	yamlUnmarshalerType = reflect.TypeFor[yaml.Unmarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// checkFields rejects mapping keys that don't match a field of the struct they are decoded into, which yaml.v3 silently
+// ignores when decoding nodes.
+func checkFields(node *yaml.Node, t reflect.Type) error {
+	if node.Kind == yaml.AliasNode {
+		return checkFields(node.Alias, t)
+	}
+	ptr := reflect.PointerTo(t)
+	if ptr.Implements(yamlUnmarshalerType) || ptr.Implements(textUnmarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return checkFields(node, t.Elem())
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for _, item := range node.Content {
+			if err := checkFields(item, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := checkFields(node.Content[i], t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		if !structFields(t, fields) {
+			return nil
+		}
+		for i := 0; i < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				return errorAt(key, "Unknown field %q in %v", key.Value, t)
+			}
+			if err := checkFields(node.Content[i+1], fieldType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// structFields collects the yaml keys of the struct fields, including inlined ones. It reports false if the struct
+// inlines a map, which accepts any key.
+func structFields(t reflect.Type, fields map[string]reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(opts, "inline") {
+			if f.Type.Kind() == reflect.Map {
+				return false
+			}
+			if !structFields(f.Type, fields) {
+				return false
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return true
+}
+
+// Spawner spawns entities and builds their hierarchy. It is implemented by hayal.SystemCtx, ecs.SystemCtx and
+// *ecs.ECS.
+type Spawner interface {
+	Spawn(cmps ...any) (ecs.Entity, error)
+	SetParent(child ecs.Entity, parent ecs.Entity) error
+}
+
+// SpawnScene spawns the entities of the scene and returns them in the order they appear in the scene, parents before
+// their children.
+func SpawnScene(ctx Spawner, scene *Scene) ([]ecs.Entity, error) {
+	var spawned []ecs.Entity
+	var spawn func(entities []*entity, parent *ecs.Entity) error
+	spawn = func(entities []*entity, parent *ecs.Entity) error {
+		for _, e := range entities {
+			cmps := make([]any, len(e.components))
+			for i, c := range e.components {
+				cmp, err := c.decode()
+				if err != nil {
+					return err
+				}
+				cmps[i] = cmp
+			}
+			entity, err := ctx.Spawn(cmps...)
+			if err != nil {
+				return err
+			}
+			spawned = append(spawned, entity)
+			if parent != nil {
+				if err := ctx.SetParent(entity, *parent); err != nil {
+					return err
+				}
+			}
+			if err := spawn(e.children, &entity); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := spawn(scene.entities, nil); err != nil {
+		return nil, err
+	}
+	return spawned, nil
+}
@@ -0,0 +1,317 @@
+package scene
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/otanriverdi/hayal/assets"
+	"github.com/otanriverdi/hayal/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+type position struct {
+	X, Y float64
+}
+
+type gun struct {
+	Damage int
+	Tags   []string
+	Spread float64 `yaml:"spread_angle"`
+}
+
+type player struct{}
+
+func TestScene(t *testing.T) {
+	types := ecs.NewTypeRegistry()
+	assert.NoError(t, ecs.RegisterType[position](types, "Position"))
+	assert.NoError(t, ecs.RegisterType[gun](types, "Gun"))
+	assert.NoError(t, ecs.RegisterType[player](types, "Player"))
+
+	t.Run("spawns entities and hierarchy", func(t *testing.T) {
+		scene, err := Parse([]byte(`
+entities:
+  - name: ship
+    components:
+      Position: {x: 10, y: 5}
+      Player: {}
+    children:
+      - name: gun
+        components:
+          Position: {x: 1}
+          Gun: {damage: 3, tags: [laser], spread_angle: 0.5}
+  - components:
+      Position: {}
+`), types)
+		assert.NoError(t, err)
+		world := ecs.New()
+		entities, err := SpawnScene(&world, scene)
+		assert.NoError(t, err)
+		assert.Len(t, entities, 3)
+		shipIdx, ok := scene.Index("ship")
+		assert.True(t, ok)
+		gunIdx, ok := scene.Index("gun")
+		assert.True(t, ok)
+		ship, gunEntity := entities[shipIdx], entities[gunIdx]
+		assert.Equal(t, []ecs.Entity{gunEntity}, slices.Collect(world.Descendants(ship)))
+
+		q, err := ecs.NewQuery2[position, gun](&world)
+		assert.NoError(t, err)
+		row, ok := q.Get(gunEntity)
+		assert.True(t, ok)
+		assert.Equal(t, position{X: 1}, *row.C1)
+		assert.Equal(t, gun{Damage: 3, Tags: []string{"laser"}, Spread: 0.5}, *row.C2)
+
+		again, err := SpawnScene(&world, scene)
+		assert.NoError(t, err)
+		other, _ := q.Get(again[gunIdx])
+		other.C2.Tags[0] = "plasma"
+		row, _ = q.Get(gunEntity)
+		assert.Equal(t, "laser", row.C2.Tags[0], "spawned entities don't share data")
+	})
+
+	t.Run("spawns through commands", func(t *testing.T) {
+		scene, err := Parse([]byte(`
+entities:
+  - components: {Player: {}}
+    children:
+      - components: {Position: {x: 2}}
+`), types)
+		assert.NoError(t, err)
+		world := ecs.New()
+		cmds := ecs.NewCommands(&world)
+		entities, err := SpawnScene(cmds, scene)
+		assert.NoError(t, err)
+		assert.False(t, world.IsAlive(entities[0]))
+		assert.NoError(t, cmds.Apply())
+		assert.Equal(t, []ecs.Entity{entities[0]}, slices.Collect(world.Ancestors(entities[1])))
+	})
+
+	t.Run("points to the offending line", func(t *testing.T) {
+		cases := map[string]string{
+			"unknown type": `
+entities:
+  - components:
+      Position: {}
+      Health: {hp: 3}
+`,
+			"unknown field": `
+entities:
+  - components:
+      Position: {x: 1}
+
+      Gun: {damage: 1, range: 3}
+`,
+			"bad value": `
+entities:
+  - children:
+      - components:
+          Gun:
+            damage: lots
+`,
+			"unknown entity field": `
+entities:
+  - components: {}
+    childs: []
+`,
+			"duplicate name": `
+entities:
+  - name: a
+  - children:
+      - name: a
+`,
+			"unknown prefab": `
+entities:
+  - prefab: tank
+`,
+		}
+		expected := map[string]string{
+			"unknown type":         `Line 5, column 7: Unknown component type "Health"`,
+			"unknown field":        `Line 6, column 24: Unknown field "range" in scene.gun`,
+			"bad value":            "Line 6, column 13: Invalid component \"Gun\": yaml: unmarshal errors:\n  line 6: cannot unmarshal !!str `lots` into int",
+			"unknown entity field": `Line 4, column 5: Unknown field "childs"`,
+			"duplicate name":       `Line 5, column 15: Duplicate entity name "a"`,
+			"unknown prefab":       `Line 3, column 13: Unknown prefab "tank"`,
+		}
+		for name, data := range cases {
+			_, err := Parse([]byte(data), types)
+			assert.EqualError(t, err, expected[name], name)
+		}
+	})
+}
+
+func TestPrefab(t *testing.T) {
+	types := ecs.NewTypeRegistry()
+	assert.NoError(t, ecs.RegisterType[position](types, "Position"))
+	assert.NoError(t, ecs.RegisterType[gun](types, "Gun"))
+	assert.NoError(t, ecs.RegisterType[player](types, "Player"))
+
+	turret, err := ParsePrefab([]byte(`
+components:
+  Position: {x: 1}
+children:
+  - components:
+      Gun: {damage: 3}
+`), types)
+	assert.NoError(t, err)
+	ship, err := ParsePrefab([]byte(`
+prefab: turret
+components:
+  Player: {}
+children:
+  - prefab: turret
+    components:
+      Position: {x: 2}
+`), types, WithPrefabs(map[string]*Prefab{"turret": turret}))
+	assert.NoError(t, err)
+
+	t.Run("instantiates nested prefabs", func(t *testing.T) {
+		world := ecs.New()
+		roots, err := Instantiate(&world, ship, 2, position{X: 9})
+		assert.NoError(t, err)
+		assert.Len(t, roots, 2)
+
+		pos, err := ecs.NewQuery1[position](&world)
+		assert.NoError(t, err)
+		guns, err := ecs.NewQuery1[gun](&world)
+		assert.NoError(t, err)
+		for _, root := range roots {
+			row, _ := pos.Get(root)
+			assert.Equal(t, position{X: 9}, *row.C1, "overrides apply to the root")
+			var positions []position
+			damage := 0
+			for e := range world.Descendants(root) {
+				if row, ok := pos.Get(e); ok {
+					positions = append(positions, *row.C1)
+				}
+				if row, ok := guns.Get(e); ok {
+					damage += row.C1.Damage
+				}
+			}
+			assert.ElementsMatch(t, []position{{X: 2}}, positions)
+			assert.Equal(t, 6, damage)
+		}
+	})
+
+	t.Run("does not share slices between instances", func(t *testing.T) {
+		armed, err := ParsePrefab([]byte(`
+components:
+  Gun: {damage: 1, tags: [laser]}
+children:
+  - components:
+      Gun: {tags: [spare]}
+`), types)
+		assert.NoError(t, err)
+		world := ecs.New()
+		first, err := Instantiate(&world, armed, 2)
+		assert.NoError(t, err)
+		second, err := Instantiate(&world, armed, 1)
+		assert.NoError(t, err)
+		guns, err := ecs.NewQuery1[gun](&world)
+		assert.NoError(t, err)
+		row, _ := guns.Get(first[0])
+		row.C1.Tags[0] = "plasma"
+		for _, root := range []ecs.Entity{first[1], second[0]} {
+			row, _ := guns.Get(root)
+			assert.Equal(t, gun{Damage: 1, Tags: []string{"laser"}}, *row.C1)
+		}
+		child := slices.Collect(world.Descendants(first[0]))[0]
+		row, _ = guns.Get(child)
+		row.C1.Tags[0] = "broken"
+		child = slices.Collect(world.Descendants(first[1]))[0]
+		row, _ = guns.Get(child)
+		assert.Equal(t, []string{"spare"}, row.C1.Tags)
+
+		_, err = Instantiate(&world, armed, -1)
+		assert.Error(t, err)
+	})
+
+	t.Run("keeps compiled prefabs in the world", func(t *testing.T) {
+		world := ecs.New()
+		_, err := Instantiate(&world, turret, 1)
+		assert.NoError(t, err)
+		cache, err := ecs.Resource[prefabCache](&world)
+		assert.NoError(t, err)
+		compiled := cache.compiled[turret]
+		assert.NotNil(t, compiled)
+		_, err = Instantiate(&world, turret, 1)
+		assert.NoError(t, err)
+		assert.Len(t, cache.compiled, 1)
+		assert.Same(t, compiled, cache.compiled[turret], "prefabs are compiled once per world")
+
+		other := ecs.New()
+		_, err = Instantiate(&other, turret, 1)
+		assert.NoError(t, err)
+		otherCache, err := ecs.Resource[prefabCache](&other)
+		assert.NoError(t, err)
+		assert.NotSame(t, compiled, otherCache.compiled[turret])
+	})
+
+	t.Run("instantiates through commands", func(t *testing.T) {
+		world := ecs.New()
+		cmds := ecs.NewCommands(&world)
+		roots, err := Instantiate(cmds, turret, 3)
+		assert.NoError(t, err)
+		assert.False(t, world.IsAlive(roots[0]))
+		assert.NoError(t, cmds.Apply())
+		for _, root := range roots {
+			assert.Len(t, slices.Collect(world.Descendants(root)), 1)
+		}
+	})
+
+	t.Run("loads as assets", func(t *testing.T) {
+		server := assets.NewServer(fstest.MapFS{
+			"turret.prefab.yaml": {Data: []byte("components: {Position: {x: 1}}")},
+			"level.scene.yaml":   {Data: []byte("entities: [{prefab: turret}]")},
+		})
+		defer server.Close()
+		prefabs := map[string]*Prefab{"turret": turret}
+		assert.NoError(t, server.AddLoader(PrefabLoader(types)))
+		assert.NoError(t, server.AddLoader(SceneLoader(types, WithPrefabs(prefabs))))
+		prefab, err := assets.Load[*Prefab](server, "turret.prefab.yaml")
+		assert.NoError(t, err)
+		level, err := assets.Load[*Scene](server, "level.scene.yaml")
+		assert.NoError(t, err)
+		server.Wait()
+
+		world := ecs.New()
+		loadedPrefab, ok := prefab.Get()
+		assert.True(t, ok)
+		roots, err := Instantiate(&world, loadedPrefab, 1)
+		assert.NoError(t, err)
+		loadedScene, ok := level.Get()
+		assert.True(t, ok)
+		entities, err := SpawnScene(&world, loadedScene)
+		assert.NoError(t, err)
+		assert.Len(t, entities, 2)
+		q, err := ecs.NewQuery1[position](&world)
+		assert.NoError(t, err)
+		for _, e := range append(roots, entities[0]) {
+			row, ok := q.Get(e)
+			assert.True(t, ok)
+			assert.Equal(t, position{X: 1}, *row.C1)
+		}
+	})
+
+	t.Run("instances prefabs in scenes", func(t *testing.T) {
+		scene, err := Parse([]byte(`
+entities:
+  - name: boss
+    prefab: turret
+    components:
+      Gun: {damage: 10}
+`), types, WithPrefabs(map[string]*Prefab{"turret": turret}))
+		assert.NoError(t, err)
+		world := ecs.New()
+		entities, err := SpawnScene(&world, scene)
+		assert.NoError(t, err)
+		assert.Len(t, entities, 2)
+		idx, ok := scene.Index("boss")
+		assert.True(t, ok)
+		q, err := ecs.NewQuery2[position, gun](&world)
+		assert.NoError(t, err)
+		row, ok := q.Get(entities[idx])
+		assert.True(t, ok)
+		assert.Equal(t, gun{Damage: 10}, *row.C2)
+	})
+}
@@ -0,0 +1,175 @@
+package hayal
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+type scheduledSystem struct {
+	run    System
+	ctx    *systemCtx
+	name   string
+	before []string
+	after  []string
+	access ecs.Access
+	// Systems without declared access are assumed to access everything.
+	declared   bool
+	conditions []RunCondition
+	// Set by the error handler
+	disabled bool
+}
+
+func (sys *scheduledSystem) conflicts(other *scheduledSystem) bool {
+	return !sys.declared || !other.declared || sys.access.Conflicts(other.access)
+}
+
+// SystemOption configures a system added with AddSystem.
+type SystemOption func(sys *scheduledSystem)
+
+// Named names the system, so other systems can be ordered relative to it with Before and After.
+func Named(name string) SystemOption {
+	return func(sys *scheduledSystem) {
+		sys.name = name
+	}
+}
+
+// Before makes the system finish before the named systems of the same stage start. Naming systems of other stages is an
+// error, their order is decided by the order of the stages.
+func Before(names ...string) SystemOption {
+	return func(sys *scheduledSystem) {
+		sys.before = append(sys.before, names...)
+	}
+}
+
+// After makes the system start only after the named systems of the same stage finish. Like for Before, naming systems
+// of other stages is an error.
+func After(names ...string) SystemOption {
+	return func(sys *scheduledSystem) {
+		sys.after = append(sys.after, names...)
+	}
+}
+
+// Uses declares the components and resources the system accesses, either directly with ecs.ReadComponent and friends
+// or inferred from the typed queries it iterates. Systems that don't conflict with each other run in parallel, systems
+// that declare no access at all are assumed to access everything and run on their own.
+func Uses(declarers ...ecs.AccessDeclarer) SystemOption {
+	return func(sys *scheduledSystem) {
+		sys.declared = true
+		for _, declarer := range declarers {
+			sys.access = sys.access.Merge(declarer.Access())
+		}
+	}
+}
+
+// stagePlan holds, for every system of a stage, the systems that have to finish before it can start.
+type stagePlan struct {
+	deps [][]int
+}
+
+// allStages returns the stages of the game loop followed by the stages of the state machines.
+func (g *Game) allStages() []*stage {
+	stages := slices.Clone(g.stages)
+	for _, m := range g.stateMachines {
+		stages = append(stages, m.stages()...)
+	}
+	return stages
+}
+
+func (g *Game) hasSystem(name string) bool {
+	for _, st := range g.allStages() {
+		for _, sys := range st.systems {
+			if sys.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildPlan orders the systems of a stage. Explicit Before and After constraints come first, systems that are not
+// constrained keep the order they were added in. Conflicting systems then wait for the ones ordered before them.
+func (g *Game) buildPlan(st *stage) (*stagePlan, error) {
+	systems := st.systems
+	n := len(systems)
+	index := make(map[string]int)
+	for i, sys := range systems {
+		if sys.name == "" {
+			continue
+		}
+		if _, ok := index[sys.name]; ok {
+			return nil, fmt.Errorf("Duplicate system name %q", sys.name)
+		}
+		index[sys.name] = i
+	}
+	resolve := func(name string) (int, error) {
+		if i, ok := index[name]; ok {
+			return i, nil
+		}
+		if g.hasSystem(name) {
+			return -1, fmt.Errorf("System %q in ordering constraint is not in stage %q", name, st.name)
+		}
+		return -1, fmt.Errorf("Unknown system %q in ordering constraint", name)
+	}
+	ordered := make([][]bool, n)
+	for i := range ordered {
+		ordered[i] = make([]bool, n)
+	}
+	for i, sys := range systems {
+		for _, name := range sys.after {
+			j, err := resolve(name)
+			if err != nil {
+				return nil, err
+			}
+			ordered[j][i] = true
+		}
+		for _, name := range sys.before {
+			j, err := resolve(name)
+			if err != nil {
+				return nil, err
+			}
+			ordered[i][j] = true
+		}
+	}
+
+	indegree := make([]int, n)
+	for i := range n {
+		for j := range n {
+			if ordered[i][j] {
+				indegree[j]++
+			}
+		}
+	}
+	order := make([]int, 0, n)
+	visited := make([]bool, n)
+	for len(order) < n {
+		next := -1
+		for i := range n {
+			if !visited[i] && indegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, fmt.Errorf("Cycle in ordering constraints of stage %q", st.name)
+		}
+		visited[next] = true
+		order = append(order, next)
+		for j := range n {
+			if ordered[next][j] {
+				indegree[j]--
+			}
+		}
+	}
+
+	plan := &stagePlan{deps: make([][]int, n)}
+	for a, i := range order {
+		for _, j := range order[a+1:] {
+			if ordered[i][j] || systems[i].conflicts(systems[j]) {
+				plan.deps[j] = append(plan.deps[j], i)
+			}
+		}
+	}
+	return plan, nil
+}
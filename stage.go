@@ -0,0 +1,223 @@
+package hayal
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+type stageKind uint8
+
+const (
+	// Runs once on start
+	stageStartup stageKind = iota
+	// Runs on every tick
+	stageFrame
+	// Runs on every fixed timestep
+	stageFixed
+	// Runs once on shutdown
+	stageShutdown
+)
+
+type stage struct {
+	name       Stage
+	kind       stageKind
+	systems    []*scheduledSystem
+	conditions []RunCondition
+	// Passed into the conditions of the stage
+	ctx *systemCtx
+	// Built on start or lazily, reset when systems are added
+	plan *stagePlan
+	// Set if the plan can't be built, the stage never runs then
+	planErr error
+}
+
+func (g *Game) newStage(name Stage, kind stageKind) *stage {
+	return &stage{name: name, kind: kind, ctx: g.newSystemCtx()}
+}
+
+func (g *Game) stageIndex(name Stage) int {
+	return slices.IndexFunc(g.stages, func(st *stage) bool {
+		return st.name == name
+	})
+}
+
+func (g *Game) mustStage(name Stage) *stage {
+	idx := g.stageIndex(name)
+	if idx < 0 {
+		panic(fmt.Sprintf("Unknown stage %q", name))
+	}
+	return g.stages[idx]
+}
+
+// AddStageBefore inserts a new stage right before target. The new stage runs as often as target does: once on start
+// next to Init, for every fixed timestep next to FixedUpdate, once on shutdown next to Deinit and on every tick
+// otherwise.
+func (g *Game) AddStageBefore(target Stage, name Stage) {
+	g.insertStage(target, name, 0)
+}
+
+// AddStageAfter inserts a new stage right after target. See AddStageBefore for how often it runs.
+func (g *Game) AddStageAfter(target Stage, name Stage) {
+	g.insertStage(target, name, 1)
+}
+
+func (g *Game) insertStage(target Stage, name Stage, offset int) {
+	if g.stageIndex(name) >= 0 {
+		panic(fmt.Sprintf("Duplicate stage %q", name))
+	}
+	idx := g.stageIndex(target)
+	if idx < 0 {
+		panic(fmt.Sprintf("Unknown stage %q", target))
+	}
+	g.stages = slices.Insert(g.stages, idx+offset, g.newStage(name, g.stages[idx].kind))
+}
+
+// RunCondition decides whether a system or a stage runs. Conditions are evaluated on the game loop right before the
+// stage starts, so they must not block. Panicking conditions don't hold and are reported to the error handler.
+type RunCondition = func(ctx SystemCtx) bool
+
+// RunStageIf only runs the stage when all of the conditions hold.
+func (g *Game) RunStageIf(name Stage, conds ...RunCondition) {
+	st := g.mustStage(name)
+	st.conditions = append(st.conditions, conds...)
+}
+
+// RunIf only runs the system when all of the conditions hold.
+func RunIf(conds ...RunCondition) SystemOption {
+	return func(sys *scheduledSystem) {
+		sys.conditions = append(sys.conditions, conds...)
+	}
+}
+
+// RunEvery only runs the system on every nth run of its stage, starting with the first. It panics if n isn't positive.
+func RunEvery(n int) SystemOption {
+	return RunIf(Every(n))
+}
+
+// RunOnce only runs the system the first time its stage runs.
+func RunOnce() SystemOption {
+	return RunIf(Once())
+}
+
+// Every holds on the first and then every nth time it is evaluated. It panics if n isn't positive.
+func Every(n int) RunCondition {
+	if n <= 0 {
+		panic(fmt.Sprintf("Invalid interval %d, must be positive", n))
+	}
+	count := 0
+	return func(ctx SystemCtx) bool {
+		ok := count%n == 0
+		count++
+		return ok
+	}
+}
+
+// Once holds only the first time it is evaluated.
+func Once() RunCondition {
+	done := false
+	return func(ctx SystemCtx) bool {
+		ok := !done
+		done = true
+		return ok
+	}
+}
+
+// checkConditions evaluates every condition, so stateful conditions like Every count every evaluation. A panicking
+// condition doesn't hold and is reported as a failure of label.
+func (g *Game) checkConditions(
+	step Stage, label string, ctx SystemCtx, conds []RunCondition,
+) (ok bool, failure *SystemError) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok, failure = false, g.panicError(step, label, r)
+		}
+	}()
+	ok = true
+	for _, cond := range conds {
+		if !cond(ctx) {
+			ok = false
+		}
+	}
+	return ok, nil
+}
+
+// stageLabel names the conditions of the stage in the errors they cause.
+func stageLabel(st *stage) string {
+	return fmt.Sprintf("RunStageIf(%s)", st.name)
+}
+
+// planStage builds the plan of the stage unless it is already built, reporting invalid ordering constraints to the
+// error handler once.
+func (g *Game) planStage(st *stage) bool {
+	if st.plan != nil {
+		return true
+	}
+	if st.planErr != nil {
+		return false
+	}
+	plan, err := g.buildPlan(st)
+	if err != nil {
+		st.planErr = err
+		g.handleError(nil, &SystemError{System: "schedule", Step: st.name, Tick: g.ticks, Err: err})
+		return false
+	}
+	st.plan = plan
+	return true
+}
+
+func (g *Game) runStage(st *stage) {
+	ok, failure := g.checkConditions(st.name, stageLabel(st), st.ctx, st.conditions)
+	if failure != nil {
+		g.handleError(nil, failure)
+	}
+	if !ok {
+		return
+	}
+	if !g.planStage(st) {
+		return
+	}
+	skip := make([]bool, len(st.systems))
+	// Failed conditions are handled along with the failed systems.
+	failures := make([]*SystemError, len(st.systems))
+	for i, sys := range st.systems {
+		if sys.disabled {
+			skip[i] = true
+			continue
+		}
+		ok, failure := g.checkConditions(st.name, sys.label(), sys.ctx, sys.conditions)
+		skip[i], failures[i] = !ok, failure
+	}
+	done := make([]chan struct{}, len(st.systems))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	var wg sync.WaitGroup
+	for i, sys := range st.systems {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+			for _, dep := range st.plan.deps[i] {
+				<-done[dep]
+			}
+			if !skip[i] {
+				failures[i] = g.runSystem(st.name, sys)
+			}
+		}()
+	}
+	wg.Wait()
+	// Sync point, nothing iterates the world until the next stage starts.
+	if err := st.ctx.commands.Apply(); err != nil {
+		g.handleError(nil, &SystemError{System: stageLabel(st), Step: st.name, Tick: g.ticks, Err: err})
+	}
+	for i, sys := range st.systems {
+		if failures[i] != nil {
+			g.handleError(sys, failures[i])
+		}
+		err := sys.ctx.commands.Apply()
+		if err != nil {
+			g.handleError(sys, g.systemError(st.name, sys, err))
+		}
+	}
+}
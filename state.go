@@ -0,0 +1,168 @@
+package hayal
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+// State is the resource holding the current state of a state machine added with AddState.
+type State[S comparable] struct {
+	Current S
+}
+
+// NextState is the resource used to queue a transition of a state machine added with AddState. Transitions are applied
+// after PreUpdate, the last queued state wins.
+type NextState[S comparable] struct {
+	next    S
+	pending bool
+}
+
+// Set queues a transition to s.
+func (n *NextState[S]) Set(s S) {
+	n.next = s
+	n.pending = true
+}
+
+// StateScoped marks an entity to be destroyed along with its descendants when the game exits State.
+type StateScoped[S comparable] struct {
+	State S
+}
+
+// anyStateMachine is implemented by the state machines of every state type.
+type anyStateMachine interface {
+	// enter runs the systems of the initial state.
+	enter(g *Game)
+	transition(g *Game)
+	// stages returns the OnEnter and OnExit stages of every state.
+	stages() []*stage
+}
+
+type stateMachine[S comparable] struct {
+	initial S
+	onEnter map[S]*stage
+	onExit  map[S]*stage
+	scoped  *ecs.Query1[StateScoped[S]]
+}
+
+// AddState adds a state machine starting in initial. The systems added to the initial state with AddSystemOnEnter run
+// right after Init.
+func AddState[S comparable](g *Game, initial S) {
+	typ := reflect.TypeFor[S]()
+	if _, ok := g.states[typ]; ok {
+		panic(fmt.Sprintf("Duplicate state %v", typ))
+	}
+	scoped, err := ecs.NewQuery1[StateScoped[S]](g.World(), ecs.ReadOnly[StateScoped[S]]())
+	if err != nil {
+		panic(err)
+	}
+	m := &stateMachine[S]{initial: initial, onEnter: make(map[S]*stage), onExit: make(map[S]*stage), scoped: scoped}
+	g.states[typ] = m
+	ecs.InsertResource(g.World(), State[S]{Current: initial})
+	ecs.InsertResource(g.World(), NextState[S]{})
+	g.stateMachines = append(g.stateMachines, m)
+}
+
+// SetNextState queues a transition of the state machine of S to s.
+func SetNextState[S comparable](ctx SystemCtx, s S) error {
+	return ecs.ResourceMut(ctx.World(), func(n *NextState[S]) {
+		n.Set(s)
+	})
+}
+
+// InState holds while the state machine of S is in s.
+func InState[S comparable](s S) RunCondition {
+	return func(ctx SystemCtx) bool {
+		state, err := ecs.Resource[State[S]](ctx.World())
+		return err == nil && state.Current == s
+	}
+}
+
+// AddSystemOnEnter adds a system that runs whenever the state machine of S enters s.
+func AddSystemOnEnter[S comparable](g *Game, s S, system System, opts ...SystemOption) {
+	m := mustStateMachine[S](g)
+	g.addSystem(m.stage(g, m.onEnter, "OnEnter", s), system, opts)
+}
+
+// AddSystemOnExit adds a system that runs whenever the state machine of S exits s, before the entities scoped to s are
+// destroyed.
+func AddSystemOnExit[S comparable](g *Game, s S, system System, opts ...SystemOption) {
+	m := mustStateMachine[S](g)
+	g.addSystem(m.stage(g, m.onExit, "OnExit", s), system, opts)
+}
+
+func mustStateMachine[S comparable](g *Game) *stateMachine[S] {
+	typ := reflect.TypeFor[S]()
+	m, ok := g.states[typ]
+	if !ok {
+		panic(fmt.Sprintf("Unknown state %v", typ))
+	}
+	return m.(*stateMachine[S])
+}
+
+// stage returns the stage of s in stages, creating it if needed. State stages aren't part of the game loop, they only
+// run on transitions.
+func (m *stateMachine[S]) stage(g *Game, stages map[S]*stage, prefix string, s S) *stage {
+	st, ok := stages[s]
+	if !ok {
+		st = g.newStage(Stage(fmt.Sprintf("%s(%v)", prefix, s)), stageFrame)
+		stages[s] = st
+	}
+	return st
+}
+
+func (m *stateMachine[S]) stages() []*stage {
+	stages := slices.Collect(maps.Values(m.onEnter))
+	return append(stages, slices.Collect(maps.Values(m.onExit))...)
+}
+
+func (m *stateMachine[S]) enter(g *Game) {
+	if st, ok := m.onEnter[m.initial]; ok {
+		g.runStage(st)
+	}
+}
+
+// transition applies the queued transition, if there is one and it changes the state.
+func (m *stateMachine[S]) transition(g *Game) {
+	var next S
+	var pending bool
+	ecs.ResourceMut(g.World(), func(n *NextState[S]) {
+		next, pending = n.next, n.pending
+		n.pending = false
+	})
+	state, err := ecs.Resource[State[S]](g.World())
+	if err != nil || !pending || state.Current == next {
+		return
+	}
+	if st, ok := m.onExit[state.Current]; ok {
+		g.runStage(st)
+	}
+	if err := m.destroyScoped(g, state.Current); err != nil {
+		g.handleError(nil, &SystemError{System: "StateScoped", Step: GameLoopStepPreUpdate, Tick: g.ticks, Err: err})
+	}
+	ecs.InsertResource(g.World(), State[S]{Current: next})
+	if st, ok := m.onEnter[next]; ok {
+		g.runStage(st)
+	}
+}
+
+func (m *stateMachine[S]) destroyScoped(g *Game, s S) error {
+	var entities []ecs.Entity
+	for row := range m.scoped.Iter() {
+		if row.C1.State == s {
+			entities = append(entities, row.Entity)
+		}
+	}
+	var errs []error
+	for _, entity := range entities {
+		// Scoped entities may be descendants of each other.
+		if g.World().IsAlive(entity) {
+			errs = append(errs, g.World().DestroyRecursive(entity))
+		}
+	}
+	return errors.Join(errs...)
+}
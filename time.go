@@ -0,0 +1,149 @@
+package hayal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+// Clock tells the game what time it is. Replace the default wall clock with SetClock, for example with a ManualClock
+// to drive the game deterministically in tests.
+type Clock interface {
+	Now() time.Time
+	// Sleep blocks until d has passed on the clock.
+	Sleep(d time.Duration)
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// ManualClock is a Clock that only moves when advanced. Sleeping on it advances it right away.
+type ManualClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+// NewManualClock initializes a manual clock stopped at the passed in time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *ManualClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// Time is a resource holding the timing of the current tick. The game updates it at the start of every tick.
+type Time struct {
+	// Delta is the time passed since the previous tick.
+	Delta time.Duration
+	// Elapsed is the time passed since the first tick.
+	Elapsed time.Duration
+	// Frame is the number of the current tick, starting from 1 like SystemError.Tick. It is 0 during Init.
+	Frame uint64
+}
+
+// FixedTime is a resource holding the state of the fixed timestep.
+type FixedTime struct {
+	// Step is the time simulated by every run of GameLoopStepFixedUpdate.
+	Step time.Duration
+	// Elapsed is the time simulated by all fixed runs so far.
+	Elapsed time.Duration
+	// Alpha is how far the game is into the next fixed step, between 0 and 1. Draw systems can use it to interpolate
+	// between the previous and the current fixed state.
+	Alpha float64
+	// Time accumulated but not simulated by fixed runs yet
+	accumulator time.Duration
+}
+
+const (
+	defaultFixedTimestep = time.Second / 60
+	// maxFrameDelta caps the time a single slow frame feeds into the fixed timestep, so the game doesn't fall further
+	// behind by trying to catch up.
+	maxFrameDelta = 250 * time.Millisecond
+	// maxFixedRuns caps the fixed runs of a single frame for the same reason, time beyond it is dropped. It is above
+	// what maxFrameDelta allows with the default step, so it only kicks in for tiny steps.
+	maxFixedRuns = 16
+)
+
+// SetClock replaces the clock the game measures time with.
+func (g *Game) SetClock(clock Clock) {
+	g.clock = clock
+}
+
+// SetFixedTimestep sets the time simulated by every run of GameLoopStepFixedUpdate. Defaults to 1/60 seconds. It panics
+// if step isn't positive.
+func (g *Game) SetFixedTimestep(step time.Duration) {
+	if step <= 0 {
+		panic(fmt.Sprintf("Invalid fixed timestep %v, must be positive", step))
+	}
+	_ = ecs.ResourceMut(g.World(), func(fixed *FixedTime) {
+		fixed.Step = step
+	})
+}
+
+// advanceTime updates the Time resource for a new tick and returns how many fixed runs it needs.
+func (g *Game) advanceTime() int {
+	now := g.clock.Now()
+	if g.lastTick.IsZero() {
+		g.lastTick = now
+	}
+	delta := now.Sub(g.lastTick)
+	g.lastTick = now
+	g.ticks++
+	_ = ecs.ResourceMut(g.World(), func(t *Time) {
+		t.Elapsed += delta
+		t.Delta = delta
+		t.Frame = g.ticks
+	})
+	runs := 0
+	_ = ecs.ResourceMut(g.World(), func(fixed *FixedTime) {
+		if fixed.Step <= 0 {
+			return
+		}
+		fixed.accumulator += min(delta, maxFrameDelta)
+		runs = int(fixed.accumulator / fixed.Step)
+		if runs > maxFixedRuns {
+			fixed.accumulator -= time.Duration(runs-maxFixedRuns) * fixed.Step
+			runs = maxFixedRuns
+		}
+	})
+	return runs
+}
+
+// advanceFixedTime consumes a single fixed step from the accumulator.
+func (g *Game) advanceFixedTime() {
+	_ = ecs.ResourceMut(g.World(), func(fixed *FixedTime) {
+		fixed.accumulator -= fixed.Step
+		fixed.Elapsed += fixed.Step
+	})
+}
+
+func (g *Game) updateAlpha() {
+	_ = ecs.ResourceMut(g.World(), func(fixed *FixedTime) {
+		if fixed.Step > 0 {
+			fixed.Alpha = float64(fixed.accumulator) / float64(fixed.Step)
+		}
+	})
+}
@@ -0,0 +1,236 @@
+// Package transform2d provides 2D transforms that are propagated down the entity hierarchy.
+//
+// Entities get a local Transform2D, relative to their parent, and a GlobalTransform2D that the plugin computes after
+// the Update stage:
+//
+//	game.Plug(transform2d.Plugin)
+//	e, err := ctx.Spawn(transform2d.FromTranslation(10, 5), transform2d.GlobalTransform2D{})
+//	err = ctx.SetParent(e, ship)
+//
+// Entities with a Transform2D but without a GlobalTransform2D get one added, and computed on the next tick. Global
+// transforms are only recomputed for entities that moved, got reparented or whose ancestors did.
+package transform2d
+
+import (
+	"math"
+
+	"github.com/otanriverdi/hayal"
+	"github.com/otanriverdi/hayal/ecs"
+)
+
+// Stage is inserted after Update by the plugin. Global transforms are up to date once it has run.
+const Stage hayal.Stage = "TransformPropagate"
+
+type Vec2 struct {
+	X float64
+	Y float64
+}
+
+// Transform2D is the transform of an entity relative to its parent, or to the world if it has no parent.
+type Transform2D struct {
+	Translation Vec2
+	// Counter-clockwise, in radians
+	Rotation float64
+	Scale    Vec2
+}
+
+// Identity returns a transform that doesn't move, rotate or scale.
+func Identity() Transform2D {
+	return Transform2D{Scale: Vec2{X: 1, Y: 1}}
+}
+
+// FromTranslation returns a transform that only moves.
+func FromTranslation(x float64, y float64) Transform2D {
+	t := Identity()
+	t.Translation = Vec2{X: x, Y: y}
+	return t
+}
+
+func (t Transform2D) affine() affine {
+	sin, cos := math.Sincos(t.Rotation)
+	return affine{
+		a: cos * t.Scale.X, b: sin * t.Scale.X,
+		c: -sin * t.Scale.Y, d: cos * t.Scale.Y,
+		tx: t.Translation.X, ty: t.Translation.Y,
+	}
+}
+
+// affine is a 2D affine transform, the matrix
+//
+//	a c tx
+//	b d ty
+type affine struct {
+	a, b, c, d, tx, ty float64
+}
+
+var identity = affine{a: 1, d: 1}
+
+// mul returns the transform applying o first, then m.
+func (m affine) mul(o affine) affine {
+	return affine{
+		a:  m.a*o.a + m.c*o.b,
+		b:  m.b*o.a + m.d*o.b,
+		c:  m.a*o.c + m.c*o.d,
+		d:  m.b*o.c + m.d*o.d,
+		tx: m.a*o.tx + m.c*o.ty + m.tx,
+		ty: m.b*o.tx + m.d*o.ty + m.ty,
+	}
+}
+
+// GlobalTransform2D is the transform of an entity relative to the world. It is computed by the plugin from the
+// Transform2D of the entity and its ancestors and must not be set by hand.
+type GlobalTransform2D struct {
+	matrix affine
+}
+
+// Translation returns the position of the entity in the world.
+func (g GlobalTransform2D) Translation() Vec2 {
+	return Vec2{X: g.matrix.tx, Y: g.matrix.ty}
+}
+
+// Rotation returns the rotation of the entity in the world, in radians.
+func (g GlobalTransform2D) Rotation() float64 {
+	return math.Atan2(g.matrix.b, g.matrix.a)
+}
+
+// Scale returns the scale of the entity in the world. It is only exact if no ancestor combines rotation with non
+// uniform scale.
+func (g GlobalTransform2D) Scale() Vec2 {
+	return Vec2{X: math.Hypot(g.matrix.a, g.matrix.b), Y: math.Hypot(g.matrix.c, g.matrix.d)}
+}
+
+// TransformPoint maps a point from the local space of the entity to the world.
+func (g GlobalTransform2D) TransformPoint(p Vec2) Vec2 {
+	m := g.matrix
+	return Vec2{X: m.a*p.X + m.c*p.Y + m.tx, Y: m.b*p.X + m.d*p.Y + m.ty}
+}
+
+// Plugin adds the stage and the systems that keep global transforms up to date. Only the subtrees of entities whose
+// transform, global transform or parent changed since the previous tick are recomputed, so GlobalTransform2D only
+// counts as changed for the entities that actually moved.
+func Plugin(g *hayal.Game) {
+	world := g.World()
+	moved, err := ecs.NewQuery1[Transform2D](
+		world, ecs.With[GlobalTransform2D](), ecs.Changed[Transform2D](), ecs.ReadOnly[Transform2D](),
+	)
+	if err != nil {
+		panic(err)
+	}
+	added, err := ecs.NewQuery1[GlobalTransform2D](
+		world, ecs.Added[GlobalTransform2D](), ecs.ReadOnly[GlobalTransform2D](),
+	)
+	if err != nil {
+		panic(err)
+	}
+	reparented, err := ecs.NewQuery1[ecs.Parent](
+		world, ecs.With[GlobalTransform2D](), ecs.Changed[ecs.Parent](), ecs.ReadOnly[ecs.Parent](),
+	)
+	if err != nil {
+		panic(err)
+	}
+	// Entities that lost their parent became roots.
+	orphaned, err := ecs.NewRemovedComponents[ecs.Parent](world)
+	if err != nil {
+		panic(err)
+	}
+	nodes, err := ecs.NewQuery2[Transform2D, GlobalTransform2D](
+		world, ecs.ReadOnly[Transform2D](), ecs.ReadOnly[GlobalTransform2D](),
+	)
+	if err != nil {
+		panic(err)
+	}
+	// Used to write and mark the recomputed global transforms.
+	globals, err := ecs.NewQuery1[GlobalTransform2D](world)
+	if err != nil {
+		panic(err)
+	}
+	parents, err := ecs.NewQuery1[ecs.Parent](world, ecs.ReadOnly[ecs.Parent]())
+	if err != nil {
+		panic(err)
+	}
+	children, err := ecs.NewQuery1[ecs.Children](world, ecs.ReadOnly[ecs.Children]())
+	if err != nil {
+		panic(err)
+	}
+	missing, err := ecs.NewQuery1[Transform2D](
+		world, ecs.Without[GlobalTransform2D](), ecs.ReadOnly[Transform2D](),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	// parentMatrix returns the global transform of the parent of the entity, or false if the parent has no transform.
+	parentMatrix := func(entity ecs.Entity) (affine, bool) {
+		p, ok := parents.Get(entity)
+		if !ok {
+			return identity, true
+		}
+		node, ok := nodes.Get(p.C1.Entity())
+		if !ok {
+			// Entities without transforms cut the hierarchy.
+			return affine{}, false
+		}
+		return node.C2.matrix, true
+	}
+	var propagate func(entity ecs.Entity, parent affine)
+	propagate = func(entity ecs.Entity, parent affine) {
+		node, ok := nodes.Get(entity)
+		if !ok {
+			return
+		}
+		global, _ := globals.Get(entity)
+		global.C1.matrix = parent.mul(node.C1.affine())
+		global.Mark()
+		c, ok := children.Get(entity)
+		if !ok {
+			return
+		}
+		for _, child := range c.C1.Entities() {
+			propagate(child, global.C1.matrix)
+		}
+	}
+
+	g.AddStageAfter(hayal.GameLoopStateUpdate, Stage)
+	g.AddSystem(Stage, func(ctx hayal.SystemCtx) error {
+		for row := range missing.Iter() {
+			if err := ctx.AddComponent(row.Entity, GlobalTransform2D{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, hayal.Named("transform2d.insert"), hayal.Uses(missing))
+	g.AddSystem(Stage, func(ctx hayal.SystemCtx) error {
+		dirty := make(map[ecs.Entity]bool)
+		for row := range moved.Iter() {
+			dirty[row.Entity] = true
+		}
+		for row := range added.Iter() {
+			dirty[row.Entity] = true
+		}
+		for row := range reparented.Iter() {
+			dirty[row.Entity] = true
+		}
+		for _, entity := range orphaned.Read() {
+			dirty[entity] = true
+		}
+		for entity := range dirty {
+			// Subtrees of dirty ancestors are recomputed from the ancestor.
+			covered := false
+			for ancestor := entity; !covered; {
+				p, ok := parents.Get(ancestor)
+				if !ok {
+					break
+				}
+				ancestor = p.C1.Entity()
+				covered = dirty[ancestor]
+			}
+			if covered {
+				continue
+			}
+			if parent, ok := parentMatrix(entity); ok {
+				propagate(entity, parent)
+			}
+		}
+		return nil
+	}, hayal.Named("transform2d.propagate"), hayal.Uses(moved, added, reparented, nodes, globals, parents, children))
+}
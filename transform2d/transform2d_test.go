@@ -0,0 +1,134 @@
+package transform2d
+
+import (
+	"math"
+	"testing"
+
+	"github.com/otanriverdi/hayal"
+	"github.com/otanriverdi/hayal/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPropagation(t *testing.T) {
+	setup := func(t *testing.T) (*hayal.Game, *ecs.Query2[Transform2D, GlobalTransform2D], []ecs.Entity) {
+		game := hayal.New()
+		game.Plug(Plugin)
+		world := game.World()
+		parent, err := world.Spawn(Transform2D{Translation: Vec2{X: 10}, Rotation: math.Pi / 2, Scale: Vec2{X: 2, Y: 2}})
+		assert.NoError(t, err)
+		child, err := world.Spawn(FromTranslation(1, 0), GlobalTransform2D{})
+		assert.NoError(t, err)
+		grandchild, err := world.Spawn(FromTranslation(0, 1), GlobalTransform2D{})
+		assert.NoError(t, err)
+		assert.NoError(t, world.SetParent(child, parent))
+		assert.NoError(t, world.SetParent(grandchild, child))
+		query, err := ecs.NewQuery2[Transform2D, GlobalTransform2D](
+			world, ecs.ReadOnly[Transform2D](), ecs.ReadOnly[GlobalTransform2D](),
+		)
+		assert.NoError(t, err)
+		return &game, query, []ecs.Entity{parent, child, grandchild}
+	}
+	locals := func(t *testing.T, game *hayal.Game) *ecs.Query1[Transform2D] {
+		query, err := ecs.NewQuery1[Transform2D](game.World())
+		assert.NoError(t, err)
+		return query
+	}
+	assertVec := func(t *testing.T, expected Vec2, actual Vec2) {
+		assert.InDelta(t, expected.X, actual.X, 1e-9)
+		assert.InDelta(t, expected.Y, actual.Y, 1e-9)
+	}
+
+	t.Run("propagates transforms down the hierarchy", func(t *testing.T) {
+		game, query, entities := setup(t)
+		game.Step()
+		parent, ok := query.Get(entities[0])
+		assert.True(t, ok, "global transform is added by the plugin")
+		assert.Equal(t, GlobalTransform2D{}, *parent.C2)
+
+		game.Step()
+		parent, _ = query.Get(entities[0])
+		assertVec(t, Vec2{X: 10}, parent.C2.Translation())
+		child, _ := query.Get(entities[1])
+		assertVec(t, Vec2{X: 10, Y: 2}, child.C2.Translation())
+		assert.InDelta(t, math.Pi/2, child.C2.Rotation(), 1e-9)
+		assertVec(t, Vec2{X: 2, Y: 2}, child.C2.Scale())
+		grandchild, _ := query.Get(entities[2])
+		assertVec(t, Vec2{X: 8, Y: 2}, grandchild.C2.Translation())
+		assertVec(t, Vec2{X: 6, Y: 2}, grandchild.C2.TransformPoint(Vec2{Y: 1}))
+
+		local, _ := locals(t, game).Get(entities[0])
+		local.C1.Translation = Vec2{}
+		local.Mark()
+		game.Step()
+		grandchild, _ = query.Get(entities[2])
+		assertVec(t, Vec2{X: -2, Y: 2}, grandchild.C2.Translation())
+	})
+
+	t.Run("only recomputes changed subtrees", func(t *testing.T) {
+		game, query, entities := setup(t)
+		game.Step()
+		game.Step()
+		stale := affine{a: 1, d: 1, tx: 42}
+		globals, err := ecs.NewQuery1[GlobalTransform2D](game.World())
+		assert.NoError(t, err)
+		global, _ := globals.Get(entities[2])
+		global.C1.matrix = stale
+		game.Step()
+		grandchild, _ := query.Get(entities[2])
+		assert.Equal(t, stale, grandchild.C2.matrix)
+
+		child, _ := locals(t, game).Get(entities[1])
+		child.C1.Rotation = math.Pi
+		child.Mark()
+		game.Step()
+		grandchild, _ = query.Get(entities[2])
+		assert.NotEqual(t, stale, grandchild.C2.matrix)
+		assertVec(t, Vec2{X: 12, Y: 2}, grandchild.C2.Translation())
+	})
+
+	t.Run("recomputes reparented entities", func(t *testing.T) {
+		game, query, entities := setup(t)
+		game.Step()
+		game.Step()
+		assert.NoError(t, game.World().SetParent(entities[2], entities[0]))
+		game.Step()
+		grandchild, _ := query.Get(entities[2])
+		assertVec(t, Vec2{X: 8}, grandchild.C2.Translation())
+
+		assert.NoError(t, game.World().RemoveParent(entities[2]))
+		game.Step()
+		grandchild, _ = query.Get(entities[2])
+		assertVec(t, Vec2{Y: 1}, grandchild.C2.Translation())
+	})
+	t.Run("only marks recomputed global transforms changed", func(t *testing.T) {
+		game, _, entities := setup(t)
+		game.Step()
+		game.Step()
+		changed, err := ecs.NewQuery1[GlobalTransform2D](
+			game.World(), ecs.Changed[GlobalTransform2D](), ecs.ReadOnly[GlobalTransform2D](),
+		)
+		assert.NoError(t, err)
+		collect := func() []ecs.Entity {
+			var entities []ecs.Entity
+			for row := range changed.Iter() {
+				entities = append(entities, row.Entity)
+			}
+			return entities
+		}
+		collect()
+		game.Step()
+		assert.Empty(t, collect(), "nothing is recomputed on idle ticks")
+		for range locals(t, game).Iter() {
+		}
+		game.Step()
+		assert.Empty(t, collect(), "iterating transforms doesn't move them")
+
+		child, _ := locals(t, game).Get(entities[1])
+		child.C1.Translation = Vec2{X: 2}
+		child.Mark()
+		game.Step()
+		assert.ElementsMatch(t, entities[1:], collect())
+		game.Step()
+		assert.Empty(t, collect())
+	})
+}